@@ -7,6 +7,7 @@ import "github.com/snuk182/gnarly/network"
 import "bytes"
 import "bufio"
 import "fmt"
+import "time"
 
 type Client struct {
 	peer *network.Peer
@@ -48,7 +49,7 @@ func (this *Client) Run(addr string) (err error) {
 	fmt.Printf("[i] Listening on: %v\n", pubaddr)
 
 	// Hook up the input polling from stdin.
-	go this.input(pubaddr)
+	go this.input()
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
@@ -74,10 +75,10 @@ func (this *Client) onMessage(peer *network.Peer, msgtype uint8, data interface{
 	case network.MsgPeerDisconnected:
 		fmt.Printf("[i] Peer disconnected: %s\n", peer.Id)
 	case network.MsgLatency:
-		fmt.Printf("[i] Latency for %v: %d microseconds\n", peer.Id, data.(uint16))
+		fmt.Printf("[i] Latency for %v: %v\n", peer.Id, data.(time.Duration))
 	case network.MsgData:
 		fmt.Printf("[i] From: %v\n", peer.Id)
-		fmt.Printf("[i] Sequence #: 0x%04x\n", peer.Sequence)
+		fmt.Printf("[i] Sequence #: 0x%04x\n", peer.RemoteSequence)
 		fmt.Printf("[i] Data: %+v\n\n", data.([]byte))
 	}
 }
@@ -87,10 +88,9 @@ func (this *Client) onError(err error) bool {
 	return false
 }
 
-func (this *Client) input(addr *net.UDPAddr) {
-	var line, data []byte
+func (this *Client) input() {
+	var line []byte
 	var err error
-	var size int
 
 	fmt.Fprint(os.Stdout, "[i] Type some text and hit <enter> or ctrl-c to quit.\n")
 
@@ -111,16 +111,8 @@ func (this *Client) input(addr *net.UDPAddr) {
 		line = bytes.Join(bytes.Split(line, newline[0]), newline[1])
 		line = bytes.Join(bytes.Split(line, tab[0]), tab[1])
 
-		size = len(line) + 1
-		if size >= cap(data) {
-			data = make([]byte, size, size)
-		}
-
-		data = data[0:size]
-		data[0] = network.MsgData
-		copy(data[1:], line)
-
-		if err = this.peer.Send(addr, data); err != nil {
+		// We talk to ourselves, so the listener's own address is our target.
+		if err = this.peer.Send(line); err != nil {
 			fmt.Fprintf(os.Stderr, "[e] %v\n", err)
 		}
 	}
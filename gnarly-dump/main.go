@@ -0,0 +1,8 @@
+package main
+
+import "os"
+import "github.com/snuk182/gnarly/network/dump"
+
+func main() {
+	os.Exit(dump.Main(os.Args[1:], os.Stdout, os.Stderr))
+}
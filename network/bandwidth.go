@@ -0,0 +1,206 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Bandwidth limits, in bytes per second, including packet headers. 0 means
+// unlimited. See Config.PeerLimits.
+type Limits struct {
+	Send    int // Traffic we send. Packets are paced to stay below it.
+	Receive int // Traffic we accept. Packets beyond it are dropped.
+}
+
+// Longest a message may wait for the send limits by default. See
+// Config.MaxSendDelay.
+const defaultSendDelay = 250 * time.Millisecond
+
+// Period whose worth of data the receive limits let through in one burst.
+// Packets bunch up on their way to us, so this is more lenient than the
+// pacing of the sender.
+const receiveBurst = 250 * time.Millisecond
+
+// Spaces out packets to keep them below a rate. Rather than letting a burst
+// through and then waiting for tokens, each packet leaves once the previous
+// one would have been done at that rate.
+type pacer struct {
+	next int64 // Time the link is free again, in nanoseconds.
+}
+
+// Returns the earliest time, not before now, at which a packet may leave.
+func (this *pacer) ready(now int64) int64 {
+	if this.next > now {
+		return this.next
+	}
+	return now
+}
+
+// Reserves the link for a packet of n bytes which leaves at time at. A rate of
+// 0 means unlimited.
+func (this *pacer) reserve(at int64, n, rate int) {
+	if rate > 0 {
+		this.next = at + int64(n)*1e9/int64(rate)
+	}
+}
+
+// Takes n bytes from a bucket which fills at the given rate. The bucket is
+// set up on first use, full. A rate of 0 means unlimited.
+func (this *tokenBucket) allow(now int64, n, rate int) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	if this.rate != float64(rate) {
+		this.rate = float64(rate)
+		this.burst = this.rate * receiveBurst.Seconds()
+		this.tokens = this.burst
+		this.last = now
+	}
+	return this.take(now, n)
+}
+
+// A packet held back by pacing.
+type paced struct {
+	at   int64 // Time it may leave, in nanoseconds.
+	addr net.Addr
+	buf  *buffer
+	seqs int // Number of packets, from this one on, to number when it leaves. See hold.
+}
+
+// The bandwidth limit state of a peer. See Config.PeerLimits.
+type bandwidth struct {
+	send    pacer       // Paces what we send to the peer. Guarded by its outlock.
+	queue   []paced     // Packets waiting for their time. Guarded by the peer's outlock.
+	armed   bool        // A flush of the queue is scheduled. Guarded by the peer's outlock.
+	receive tokenBucket // Limits what we accept from the peer. Only used while processing its packets.
+}
+
+// The bandwidth limits of a listener.
+type limits struct {
+	lock    sync.Mutex
+	peer    Limits      // For each peer.
+	total   Limits      // For all peers together.
+	delay   int64       // Config.MaxSendDelay, in nanoseconds.
+	send    pacer       // Paces all we send. Guarded by lock.
+	receive tokenBucket // Limits all we accept. Only used by the polling goroutine.
+}
+
+// Sets the limits from the given config.
+func (this *limits) start(cfg *Config) {
+	this.lock.Lock()
+	this.peer = cfg.PeerLimits
+	this.total = cfg.Limits
+	this.delay = int64(cfg.MaxSendDelay)
+	this.lock.Unlock()
+}
+
+// Returns how long a packet sent to dst at time now would wait for the send
+// limits.
+func (this *Peer) backlog(dst *Peer, now int64) time.Duration {
+	dst.outlock.Lock()
+	at := dst.bw.send.ready(now)
+	dst.outlock.Unlock()
+
+	this.limits.lock.Lock()
+	at = this.limits.send.ready(at)
+	this.limits.lock.Unlock()
+	return time.Duration(at - now)
+}
+
+// Reserves the send limits for a packet of n bytes to dst, ready at time now.
+// Returns the time it may leave, and whether it has to be held back until
+// then. Messages used by the library itself count towards the limits, but are
+// never held back. Called with dst.outlock held.
+func (this *Peer) pace(dst *Peer, now int64, n int, msgtype uint8) (at int64, held bool) {
+	this.limits.lock.Lock()
+	rate := this.limits.peer.Send
+	if dst == this {
+		rate = 0 // Not one of our peers.
+	}
+
+	at = this.limits.send.ready(dst.bw.send.ready(now))
+	this.limits.send.reserve(at, n, this.limits.total.Send)
+	this.limits.lock.Unlock()
+
+	dst.bw.send.reserve(at, n, rate)
+
+	if msgtype != MsgData {
+		return now, false
+	}
+
+	// Earlier packets may still be waiting, if the timer is late.
+	return at, at > now || len(dst.bw.queue) > 0
+}
+
+// Queues a copy of a packet to dst, to be sent at time at. When it leaves, the
+// seqs packets from there on get their sequence numbers, so the fragments of
+// a message stay consecutive. The packet is sealed already if seqs is 0,
+// unless it is numbered along with the first fragment of its message. Called
+// with dst.outlock held.
+func (this *Peer) hold(dst *Peer, now, at int64, addr net.Addr, pkt []uint8, seqs int) {
+	buf := getBuffer(len(pkt))
+	copy(buf.b, pkt)
+	dst.bw.queue = append(dst.bw.queue, paced{at: at, addr: addr, buf: buf, seqs: seqs})
+
+	if !dst.bw.armed {
+		dst.bw.armed = true
+		this.clock.AfterFunc(time.Duration(at-now), func() { this.flush(dst) })
+	}
+}
+
+// Sends the queued packets of dst which are due, and schedules the next call
+// for the rest. Errors are dropped: there is no one left to report them to.
+// Once we are closed, the queue is discarded instead.
+func (this *Peer) flush(dst *Peer) {
+	dst.outlock.Lock()
+	defer dst.outlock.Unlock()
+
+	this.lock.Lock()
+	closed := this.transport == nil
+	this.lock.Unlock()
+
+	if closed {
+		dst.bw.discard()
+		return
+	}
+
+	now := this.clock.Now().UnixNano()
+	q := dst.bw.queue
+
+	n := 0
+	for ; n < len(q) && q[n].at <= now; n++ {
+		for i := 0; i < q[n].seqs; i++ {
+			pkt := q[n+i].buf.b
+			dst.Sequence.put(pkt[offSequence:])
+			dst.Sequence++
+			Seal(pkt)
+		}
+
+		this.sendToSocket(q[n].addr, q[n].buf.b)
+		q[n].buf.release()
+		q[n] = paced{}
+	}
+
+	dst.bw.queue = append(q[:0], q[n:]...)
+	clear(q[len(dst.bw.queue):])
+
+	if len(dst.bw.queue) == 0 {
+		dst.bw.armed = false
+		return
+	}
+	this.clock.AfterFunc(time.Duration(dst.bw.queue[0].at-now), func() { this.flush(dst) })
+}
+
+// Releases the packets in the queue without sending them. Called with the
+// peer's outlock held.
+func (this *bandwidth) discard() {
+	for i := range this.queue {
+		this.queue[i].buf.release()
+	}
+
+	clear(this.queue)
+	this.queue = this.queue[:0]
+	this.armed = false
+}
@@ -0,0 +1,327 @@
+package network
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns settings for newMemoryPeer with the given limits. Pings go out once
+// a minute, unless cfg says otherwise, so they stay out of the way.
+func limited(cfg Config) *peerConfig {
+	if cfg.PingInterval == 0 {
+		cfg.PingInterval = time.Minute
+	}
+
+	cfg.Timeout = time.Hour
+	return &peerConfig{Config: cfg}
+}
+
+func TestPacer(t *testing.T) {
+	var p pacer
+
+	// 1000 bytes at 10KB/s take 100ms.
+	if at := p.ready(0); at != 0 {
+		t.Fatalf("Expected an idle pacer to let a packet out at once, got %d", at)
+	}
+	p.reserve(0, 1000, 10000)
+
+	if at := p.ready(int64(50 * time.Millisecond)); at != int64(100*time.Millisecond) {
+		t.Fatalf("Expected the next packet at 100ms, got %v", time.Duration(at))
+	}
+	p.reserve(int64(100*time.Millisecond), 1000, 10000)
+
+	// Time spent idle is not saved up for a burst.
+	if at := p.ready(int64(time.Second)); at != int64(time.Second) {
+		t.Fatalf("Expected the next packet at 1s, got %v", time.Duration(at))
+	}
+
+	// No limit.
+	p.reserve(int64(time.Second), 1000, 0)
+	if at := p.ready(int64(time.Second)); at != int64(time.Second) {
+		t.Fatalf("Expected an unlimited pacer to let a packet out at once, got %v", time.Duration(at))
+	}
+}
+
+func TestSendLimits(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	// Each message takes 1011 bytes on the wire: 100ms at this rate.
+	server, _ := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, limited(Config{PeerLimits: Limits{Send: 10110}}))
+	defer server.Close()
+
+	client, r := newMemoryPeer(t, n, clock, "10.0.0.2:7000", 2, nil, limited(Config{}))
+	defer client.Close()
+
+	client.SendTo(server.Addr, []uint8("hello"))
+	n.Flush()
+
+	peer := server.GetClient(client.Id)
+	data := make([]uint8, 1000)
+
+	// The first message leaves at once, the next ones wait their turn, up to
+	// MaxSendDelay.
+	for i := 0; i < 3; i++ {
+		if err := peer.Send(data); err != nil {
+			t.Fatalf("Send %d: %v", i, err)
+		}
+	}
+
+	if err := peer.Send(data); err != ErrSendRate {
+		t.Fatalf("Expected ErrSendRate, got %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		n.Flush()
+		if got := len(r.take(MsgData)); got != 1 {
+			t.Fatalf("Expected message %d by %dms, got %d", i, (i-1)*100, got)
+		}
+		clock.Advance(100 * time.Millisecond)
+	}
+
+	if st := peer.Stats(); st.PacketsSent != 3 {
+		t.Fatalf("Expected 3 packets sent, got %d", st.PacketsSent)
+	}
+
+	// Fragments are spread out the same way. 4000 bytes take 3 packets of
+	// at most 1378 bytes. The last one leaves after 273ms.
+	clock.Advance(time.Second)
+	if err := peer.Send(make([]uint8, 4000)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	n.Flush()
+	if got := client.Stats().PacketsReceived; got != 4 {
+		t.Fatalf("Expected the first fragment at once, got %d packets in all", got)
+	}
+
+	clock.Advance(200 * time.Millisecond)
+	n.Flush()
+	if got := client.Stats().PacketsReceived; got != 5 {
+		t.Fatalf("Expected the second fragment by 200ms, got %d packets in all", got)
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	n.Flush()
+	if got := len(r.take(MsgData)); got != 1 {
+		t.Fatalf("Expected the message by 300ms, got %d", got)
+	}
+}
+
+func TestSharedSendLimit(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	server, _ := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, limited(Config{Limits: Limits{Send: 10110}}))
+	defer server.Close()
+
+	var peers []*Peer
+	var recorders []*recorder
+	for i, addr := range []string{"10.0.0.2:7000", "10.0.0.3:7000"} {
+		client, r := newMemoryPeer(t, n, clock, addr, uint8(i+2), nil, limited(Config{}))
+		defer client.Close()
+
+		client.SendTo(server.Addr, []uint8("hello"))
+		n.Flush()
+
+		peers = append(peers, server.GetClient(client.Id))
+		recorders = append(recorders, r)
+	}
+
+	// Both peers share the limit, so the second one waits for the first.
+	data := make([]uint8, 1000)
+	for _, p := range peers {
+		if err := p.Send(data); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	n.Flush()
+	if len(recorders[0].take(MsgData)) != 1 || len(recorders[1].take(MsgData)) != 0 {
+		t.Fatalf("Expected only the first peer to receive its message at once")
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	n.Flush()
+	if got := len(recorders[1].take(MsgData)); got != 1 {
+		t.Fatalf("Expected the second peer to receive its message after 100ms, got %d", got)
+	}
+}
+
+func TestReceiveLimits(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	// 250ms worth of the rate lets 2500 bytes through in one burst, so the
+	// third 1011 byte message gets in on debt.
+	var lock sync.Mutex
+	var reported []error
+
+	eh := func(err error) bool {
+		lock.Lock()
+		reported = append(reported, err)
+		lock.Unlock()
+		return false
+	}
+
+	cfg := limited(Config{PeerLimits: Limits{Receive: 10000}})
+	cfg.ErrorHandler = eh
+	server, r := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, cfg)
+	defer server.Close()
+
+	client, _ := newMemoryPeer(t, n, clock, "10.0.0.2:7000", 2, nil, limited(Config{}))
+	defer client.Close()
+
+	burst := func() int {
+		data := make([]uint8, 1000)
+		for i := 0; i < 5; i++ {
+			if err := client.SendTo(server.Addr, data); err != nil {
+				t.Fatalf("SendTo: %v", err)
+			}
+		}
+		n.Flush()
+		return len(r.take(MsgData))
+	}
+
+	if got := burst(); got != 3 {
+		t.Fatalf("Expected 3 messages, got %d", got)
+	}
+
+	lock.Lock()
+	errs := reported
+	lock.Unlock()
+
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", errs)
+	}
+
+	var pe *PacketError
+	if !errors.As(errs[0], &pe) || pe.Err != ErrReceiveRate || pe.Addr.String() != client.Addr.String() {
+		t.Fatalf("Expected a *PacketError wrapping ErrReceiveRate, got %v", errs[0])
+	}
+
+	peer := server.GetClient(pe.PeerId)
+	if peer == nil {
+		t.Fatalf("Expected the error to name the peer")
+	}
+
+	if st := peer.Stats(); st.Dropped != 2 {
+		t.Fatalf("Expected 2 dropped packets, got %d", st.Dropped)
+	}
+
+	// The bucket refills at 10KB/s, up to the burst.
+	clock.Advance(time.Second)
+	if got := burst(); got != 3 {
+		t.Fatalf("Expected 3 messages after a second, got %d", got)
+	}
+}
+
+func TestPacedPings(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	cfg := limited(Config{PingInterval: time.Second, PeerLimits: Limits{Send: 10110}})
+	server, srec := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, cfg)
+	defer server.Close()
+
+	client, r := newMemoryPeer(t, n, clock, "10.0.0.2:7000", 2, nil, limited(Config{}))
+	defer client.Close()
+
+	client.SendTo(server.Addr, []uint8("hello"))
+	n.Flush()
+
+	peer := server.GetClient(client.Id)
+	data := make([]uint8, 1000)
+
+	// Keep the queue full for a few pings. They skip it, so the round trip
+	// time stays at the 0 of the memory network, rather than growing with
+	// the queue.
+	var sent int
+	for i := 0; i < 50; i++ {
+		for peer.Send(data) == nil {
+			sent++
+		}
+		clock.Advance(100 * time.Millisecond)
+		n.Flush()
+	}
+
+	if got := len(srec.take(MsgLatency)); got != 5 {
+		t.Fatalf("Expected 5 round trip measurements, got %d", got)
+	}
+
+	if st := peer.Stats(); st.RTT != 0 || st.RTTVar != 0 {
+		t.Fatalf("Expected the round trip time to stay at 0, got %v (variation %v)", st.RTT, st.RTTVar)
+	}
+
+	// The queued packets are numbered as they leave, so the pings which
+	// overtook them do not look like loss or reordering to the client.
+	clock.Advance(time.Second)
+	n.Flush()
+
+	if got := len(r.take(MsgData)); got != sent {
+		t.Fatalf("Expected %d messages, got %d", sent, got)
+	}
+
+	if st := client.GetClient(server.Id).Stats(); st.LossIn != 0 || st.OutOfOrder != 0 {
+		t.Fatalf("Expected no loss or reordering, got %+v", st)
+	}
+}
+
+func TestPacedClose(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	server, _ := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, limited(Config{PeerLimits: Limits{Send: 10110}}))
+	client, r := newMemoryPeer(t, n, clock, "10.0.0.2:7000", 2, nil, limited(Config{}))
+	defer client.Close()
+
+	client.SendTo(server.Addr, []uint8("hello"))
+	n.Flush()
+
+	peer := server.GetClient(client.Id)
+	data := make([]uint8, 1000)
+	for i := 0; i < 3; i++ {
+		if err := peer.Send(data); err != nil {
+			t.Fatalf("Send %d: %v", i, err)
+		}
+	}
+
+	n.Flush()
+	if got := len(r.take(MsgData)); got != 1 {
+		t.Fatalf("Expected the first message at once, got %d", got)
+	}
+
+	// The other two are still queued. Closing drops them.
+	server.Close()
+
+	peer.outlock.Lock()
+	queued, armed := len(peer.bw.queue), peer.bw.armed
+	peer.outlock.Unlock()
+
+	if queued != 0 || armed {
+		t.Fatalf("Expected Close to empty the queue, got %d packets (armed %v)", queued, armed)
+	}
+
+	// A flush which was due does nothing, and packets queued after Close
+	// are discarded when their time comes.
+	peer.outlock.Lock()
+	server.hold(peer, clock.Now().UnixNano(), clock.Now().Add(100*time.Millisecond).UnixNano(), client.Addr, sealed(0, 1, 0, 0, 9, MsgData), 0)
+	peer.outlock.Unlock()
+
+	clock.Advance(time.Second)
+	n.Flush()
+
+	peer.outlock.Lock()
+	queued = len(peer.bw.queue)
+	peer.outlock.Unlock()
+
+	if queued != 0 {
+		t.Fatalf("Expected the flush after Close to discard the queue, got %d packets", queued)
+	}
+
+	if got := len(r.take(MsgData)); got != 0 {
+		t.Fatalf("Expected no messages after Close, got %d", got)
+	}
+}
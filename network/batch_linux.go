@@ -0,0 +1,91 @@
+//go:build linux
+
+package network
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// A UDP socket which implements BatchTransport through recvmmsg/sendmmsg.
+type batchConn struct {
+	*net.UDPConn
+	v4    *ipv4.PacketConn // Set for IPv4 sockets.
+	v6    *ipv6.PacketConn // Set for IPv6 and dual stack sockets.
+	rlock sync.Mutex
+	wlock sync.Mutex
+	rmsgs []ipv4.Message // ipv4.Message and ipv6.Message are the same type.
+	wmsgs []ipv4.Message
+}
+
+// Wraps a UDP socket so it can read and write datagrams in batches.
+func newBatchConn(conn *net.UDPConn) Transport {
+	b := &batchConn{UDPConn: conn}
+
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		b.v4 = ipv4.NewPacketConn(conn)
+	} else {
+		b.v6 = ipv6.NewPacketConn(conn)
+	}
+	return b
+}
+
+func (this *batchConn) ReadBatch(msgs []Datagram) (n int, err error) {
+	this.rlock.Lock()
+	defer this.rlock.Unlock()
+
+	this.rmsgs = prepare(this.rmsgs, msgs)
+
+	if this.v4 != nil {
+		n, err = this.v4.ReadBatch(this.rmsgs, 0)
+	} else {
+		n, err = this.v6.ReadBatch(this.rmsgs, 0)
+	}
+
+	for i := 0; i < n; i++ {
+		msgs[i].N = this.rmsgs[i].N
+		msgs[i].Addr = this.rmsgs[i].Addr
+	}
+	return
+}
+
+func (this *batchConn) WriteBatch(msgs []Datagram) (n int, err error) {
+	this.wlock.Lock()
+	defer this.wlock.Unlock()
+
+	this.wmsgs = prepare(this.wmsgs, msgs)
+
+	// sendmmsg may stop early. Keep going until everything is out.
+	for n < len(msgs) && err == nil {
+		var c int
+		if this.v4 != nil {
+			c, err = this.v4.WriteBatch(this.wmsgs[n:], 0)
+		} else {
+			c, err = this.v6.WriteBatch(this.wmsgs[n:], 0)
+		}
+		n += c
+	}
+	return
+}
+
+// Points the x/net messages at the buffers of our datagrams, reusing the
+// message slice where possible.
+func prepare(list []ipv4.Message, msgs []Datagram) []ipv4.Message {
+	if cap(list) < len(msgs) {
+		list = make([]ipv4.Message, len(msgs))
+		for i := range list {
+			list[i].Buffers = make([][]byte, 1)
+		}
+	}
+
+	list = list[:len(msgs)]
+	for i := range msgs {
+		list[i].Buffers[0] = msgs[i].Buffer
+		list[i].Addr = msgs[i].Addr
+		list[i].N = 0
+	}
+	return list
+}
@@ -0,0 +1,110 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// Opens a UDP socket for batched I/O.
+func newTestBatchConn(t *testing.T, network, addr string) *batchConn {
+	conn, err := net.ListenUDP(network, mustResolve(t, network, addr))
+	if err != nil {
+		t.Skipf("ListenUDP(%q, %q): %v", network, addr, err)
+	}
+
+	return newBatchConn(conn).(*batchConn)
+}
+
+func mustResolve(t *testing.T, network, addr string) *net.UDPAddr {
+	a, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		t.Fatalf("ResolveUDPAddr(%q): %v", addr, err)
+	}
+	return a
+}
+
+// Writes a batch of datagrams from one socket to another, and reads them back.
+// Returns their source addresses.
+func roundTrip(t *testing.T, from, to *batchConn, dst net.Addr) []net.Addr {
+	out := make([]Datagram, 3)
+	for i := range out {
+		out[i] = Datagram{Buffer: []byte(fmt.Sprintf("datagram %d", i)), Addr: dst}
+	}
+
+	if n, err := from.WriteBatch(out); n != len(out) || err != nil {
+		t.Fatalf("WriteBatch to %v: %d, %v", dst, n, err)
+	}
+
+	to.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer to.SetReadDeadline(time.Time{})
+
+	var got []Datagram
+	for len(got) < len(out) {
+		in := make([]Datagram, 8)
+		for i := range in {
+			in[i].Buffer = make([]byte, 64)
+		}
+
+		n, err := to.ReadBatch(in)
+		if err != nil {
+			t.Fatalf("ReadBatch from %v: %v", dst, err)
+		}
+		got = append(got, in[:n]...)
+	}
+
+	var addrs []net.Addr
+	for i, d := range got {
+		if string(d.Buffer[:d.N]) != string(out[i].Buffer) {
+			t.Fatalf("Expected %q, got %q", out[i].Buffer, d.Buffer[:d.N])
+		}
+
+		src, ok := d.Addr.(*net.UDPAddr)
+		if !ok || src.Port != from.LocalAddr().(*net.UDPAddr).Port {
+			t.Fatalf("Expected the datagram to come from port %d, got %v", from.LocalAddr().(*net.UDPAddr).Port, d.Addr)
+		}
+		addrs = append(addrs, d.Addr)
+	}
+	return addrs
+}
+
+func TestBatchConn(t *testing.T) {
+	cases := []struct {
+		name    string
+		network string
+		addr    string
+	}{
+		{"udp4", "udp4", "127.0.0.1:0"},
+		{"udp4 wildcard", "udp4", ":0"},
+		{"udp6", "udp6", "[::1]:0"},
+
+		// Dual stack where IPv6 is available, so this takes the IPv6 path
+		// while talking to IPv4 addresses.
+		{"wildcard", "udp", ":0"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := newTestBatchConn(t, c.network, c.addr)
+			defer a.Close()
+
+			b := newTestBatchConn(t, c.network, c.addr)
+			defer b.Close()
+
+			host := "127.0.0.1"
+			if c.network == "udp6" {
+				host = "::1"
+			}
+
+			// Send to the loopback address, then answer to where the
+			// datagrams came from, as the listener does.
+			port := b.LocalAddr().(*net.UDPAddr).Port
+			dst := &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+			from := roundTrip(t, a, b, dst)
+			roundTrip(t, b, a, from[0])
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package network
+
+import (
+	"net"
+)
+
+// Batched socket I/O is only available on Linux. Elsewhere, the socket is
+// used as-is and datagrams are read and written one at a time.
+func newBatchConn(conn *net.UDPConn) Transport {
+	return conn
+}
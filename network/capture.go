@@ -0,0 +1,246 @@
+package network
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A datagram seen by a CaptureTransport.
+type Capture struct {
+	Time    time.Time
+	Inbound bool     // Set if we received the datagram, rather than sent it.
+	Local   net.Addr // Our address.
+	Remote  net.Addr // The address of the other side.
+	Data    []uint8  // The datagram as it appeared on the wire: our header and payload.
+}
+
+// Receives the datagrams seen by a CaptureTransport. Calls are serialised.
+// The capture is only valid during the call.
+type CaptureWriter interface {
+	WriteCapture(c *Capture) error
+}
+
+// Reads back the datagrams written by a CaptureWriter. Returns io.EOF at the
+// end of the capture.
+type CaptureReader interface {
+	ReadCapture() (*Capture, error)
+}
+
+// A Transport which records every datagram read from or written to the
+// wrapped transport. Set Config.Capture to tap the traffic of a peer, or wrap
+// a transport handed to Peer.Serve.
+//
+// Failing to write a capture does not affect the traffic. The first error is
+// kept, and available through Err.
+type CaptureTransport struct {
+	transport Transport
+	writer    CaptureWriter
+	clock     Clock
+	lock      sync.Mutex
+	err       error
+	capture   Capture // Reused for every datagram.
+}
+
+// Wraps t in a capture tap writing to w. A nil clock means SystemClock.
+func NewCaptureTransport(t Transport, w CaptureWriter, c Clock) *CaptureTransport {
+	if c == nil {
+		c = SystemClock
+	}
+
+	ct := new(CaptureTransport)
+	ct.transport = t
+	ct.writer = w
+	ct.clock = c
+	return ct
+}
+
+// Returns the first error returned by the CaptureWriter.
+func (this *CaptureTransport) Err() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.err
+}
+
+func (this *CaptureTransport) record(inbound bool, addr net.Addr, data []uint8) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	c := &this.capture
+	c.Time = this.clock.Now()
+	c.Inbound = inbound
+	c.Local = this.transport.LocalAddr()
+	c.Remote = addr
+	c.Data = data
+
+	if err := this.writer.WriteCapture(c); err != nil && this.err == nil {
+		this.err = err
+	}
+
+	c.Data = nil
+}
+
+func (this *CaptureTransport) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	if n, addr, err = this.transport.ReadFrom(b); err == nil {
+		this.record(true, addr, b[:n])
+	}
+	return
+}
+
+func (this *CaptureTransport) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	if n, err = this.transport.WriteTo(b, addr); err == nil {
+		this.record(false, addr, b)
+	}
+	return
+}
+
+// Reads a batch from the wrapped transport if it supports batches. Otherwise
+// this reads a single datagram.
+func (this *CaptureTransport) ReadBatch(msgs []Datagram) (n int, err error) {
+	if bt, ok := this.transport.(BatchTransport); ok {
+		n, err = bt.ReadBatch(msgs)
+	} else if len(msgs) > 0 {
+		msgs[0].N, msgs[0].Addr, err = this.transport.ReadFrom(msgs[0].Buffer)
+		if err == nil {
+			n = 1
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		this.record(true, msgs[i].Addr, msgs[i].Buffer[:msgs[i].N])
+	}
+	return
+}
+
+// Writes a batch to the wrapped transport if it supports batches. Otherwise
+// the datagrams are written one by one.
+func (this *CaptureTransport) WriteBatch(msgs []Datagram) (n int, err error) {
+	if bt, ok := this.transport.(BatchTransport); ok {
+		n, err = bt.WriteBatch(msgs)
+	} else {
+		for n < len(msgs) {
+			if _, err = this.transport.WriteTo(msgs[n].Buffer, msgs[n].Addr); err != nil {
+				break
+			}
+			n++
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		this.record(false, msgs[i].Addr, msgs[i].Buffer)
+	}
+	return
+}
+
+func (this *CaptureTransport) Close() error {
+	return this.transport.Close()
+}
+
+func (this *CaptureTransport) LocalAddr() net.Addr {
+	return this.transport.LocalAddr()
+}
+
+// Writes captures as text, one datagram per line:
+//
+//	<time> <in|out> <local> <remote> <hex data> # <decoded header>
+//
+// Empty datagrams are written as a single '-'. The decoded header is there for humans. CaptureLogReader ignores it.
+type CaptureLogWriter struct {
+	w io.Writer
+}
+
+func NewCaptureLogWriter(w io.Writer) *CaptureLogWriter {
+	return &CaptureLogWriter{w}
+}
+
+func (this *CaptureLogWriter) WriteCapture(c *Capture) error {
+	dir := "out"
+	if c.Inbound {
+		dir = "in"
+	}
+
+	decoded := "short"
+	if len(c.Data) >= HeaderSize {
+		packet := make(Packet, 16+len(c.Data))
+		copy(packet[16:], c.Data)
+		decoded = packet.String()
+	}
+
+	data := hex.EncodeToString(c.Data)
+	if data == "" {
+		data = "-"
+	}
+
+	_, err := fmt.Fprintf(this.w, "%s %s %v %v %s # %s\n",
+		c.Time.UTC().Format(time.RFC3339Nano), dir, c.Local, c.Remote, data, decoded)
+	return err
+}
+
+// Reads captures written by a CaptureLogWriter.
+type CaptureLogReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func NewCaptureLogReader(r io.Reader) *CaptureLogReader {
+	return &CaptureLogReader{r: bufio.NewReader(r)}
+}
+
+func (this *CaptureLogReader) ReadCapture() (*Capture, error) {
+	for {
+		line, err := this.r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return nil, err
+		}
+
+		this.line++
+
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue // Blank line or comment.
+		}
+
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("Invalid capture on line %d", this.line)
+		}
+
+		c := new(Capture)
+		if c.Time, err = time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+			return nil, fmt.Errorf("Invalid capture time on line %d: %v", this.line, err)
+		}
+
+		c.Inbound = fields[1] == "in"
+		c.Local = parseCaptureAddr(fields[2])
+		c.Remote = parseCaptureAddr(fields[3])
+
+		if fields[4] == "-" {
+			c.Data = []uint8{}
+		} else if c.Data, err = hex.DecodeString(fields[4]); err != nil {
+			return nil, fmt.Errorf("Invalid capture data on line %d: %v", this.line, err)
+		}
+		return c, nil
+	}
+}
+
+// The address of a non-UDP transport, as read from a capture.
+type captureAddr string
+
+func (this captureAddr) Network() string { return "capture" }
+func (this captureAddr) String() string  { return string(this) }
+
+func parseCaptureAddr(s string) net.Addr {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return net.UDPAddrFromAddrPort(ap)
+	}
+	return captureAddr(s)
+}
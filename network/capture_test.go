@@ -0,0 +1,278 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testCaptures(local, remote net.Addr) []*Capture {
+	start := time.Unix(1e9, 123456789)
+	return []*Capture{
+		{start, true, local, remote, []uint8{0, 2, 0, 0, 1, MsgData, 'h', 'i'}},
+		{start.Add(time.Millisecond), false, local, remote, []uint8{0, 1, 0, 0, 1, MsgPing}},
+		{start.Add(time.Second), true, local, remote, []uint8{}},
+	}
+}
+
+func compareCaptures(t *testing.T, r CaptureReader, want []*Capture) {
+	for i, w := range want {
+		c, err := r.ReadCapture()
+		if err != nil {
+			t.Fatalf("Capture %d: %v", i, err)
+		}
+
+		if !c.Time.Equal(w.Time) || c.Inbound != w.Inbound || !bytes.Equal(c.Data, w.Data) {
+			t.Fatalf("Capture %d: got %v %v %x, want %v %v %x", i, c.Time, c.Inbound, c.Data, w.Time, w.Inbound, w.Data)
+		}
+
+		if c.Local.String() != w.Local.String() || c.Remote.String() != w.Remote.String() {
+			t.Fatalf("Capture %d: got %v -> %v, want %v -> %v", i, c.Remote, c.Local, w.Remote, w.Local)
+		}
+	}
+
+	if _, err := r.ReadCapture(); err != io.EOF {
+		t.Fatalf("Expected io.EOF at the end, got %v", err)
+	}
+}
+
+func TestCaptureLog(t *testing.T) {
+	for _, addrs := range [][2]net.Addr{
+		{&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 7000}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}},
+		{captureAddr("/tmp/server.sock"), captureAddr("/tmp/client.sock")},
+	} {
+		var buf bytes.Buffer
+		want := testCaptures(addrs[0], addrs[1])
+
+		w := NewCaptureLogWriter(&buf)
+		for _, c := range want {
+			if err := w.WriteCapture(c); err != nil {
+				t.Fatalf("WriteCapture: %v", err)
+			}
+		}
+
+		compareCaptures(t, NewCaptureLogReader(&buf), want)
+	}
+}
+
+func TestCapturePcap(t *testing.T) {
+	for _, addrs := range [][2]net.Addr{
+		{&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 7000}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 5000}},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 7000}, &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 5000}},
+	} {
+		var buf bytes.Buffer
+		want := testCaptures(addrs[0], addrs[1])
+
+		w, err := NewPcapWriter(&buf)
+		if err != nil {
+			t.Fatalf("NewPcapWriter: %v", err)
+		}
+
+		for _, c := range want {
+			if err := w.WriteCapture(c); err != nil {
+				t.Fatalf("WriteCapture: %v", err)
+			}
+		}
+
+		compareCaptures(t, NewPcapReader(&buf), want)
+	}
+}
+
+func TestPcapChecksum(t *testing.T) {
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 1234}
+	dst := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 5678}
+	data := []uint8{0, 1, 0, 0, 7, MsgData, 1, 2, 3}
+
+	b := make([]uint8, 20+8+len(data))
+	putIPUDP(b, src, dst, data)
+
+	// A valid checksum makes the sum of the covered words 0xffff.
+	if c := fold(checksum(0, b[:20])); c != 0xffff {
+		t.Fatalf("Invalid IPv4 header checksum: %04x", c)
+	}
+
+	pseudo := checksum(0, b[12:20]) + 17 + uint32(len(b)-20)
+	if c := fold(checksum(pseudo, b[20:])); c != 0xffff {
+		t.Fatalf("Invalid UDP checksum: %04x", c)
+	}
+
+	if n := binary.BigEndian.Uint16(b[2:]); int(n) != len(b) {
+		t.Fatalf("Expected IP length %d, got %d", len(b), n)
+	}
+}
+
+func TestCaptureReplay(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	var logbuf, pcapbuf bytes.Buffer
+	pw, _ := NewPcapWriter(&pcapbuf)
+
+	cfg := &peerConfig{ErrorHandler: ignoreErrors}
+	cfg.Capture = multiCapture{NewCaptureLogWriter(&logbuf), pw}
+	server, srec := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, cfg)
+
+	client, _ := newMemoryPeer(t, n, clock, "10.0.0.2:0", 2, nil, nil)
+	defer client.Close()
+
+	big := bytes.Repeat([]uint8("0123456789"), PacketSize)
+	client.SendTo(server.Addr, []uint8("hello"))
+	client.SendTo(server.Addr, big)
+	n.Flush()
+
+	// A ping round adds outbound traffic to the capture.
+	clock.Advance(time.Second)
+	n.Flush()
+	server.Close()
+
+	if c := len(srec.take(MsgData)); c != 2 {
+		t.Fatalf("Expected 2 data messages, got %d", c)
+	}
+
+	for _, r := range []CaptureReader{NewCaptureLogReader(&logbuf), NewPcapReader(&pcapbuf)} {
+		rt, err := NewReplayTransport(r, nil)
+		if err != nil {
+			t.Fatalf("NewReplayTransport: %v", err)
+		}
+
+		if rt.LocalAddr().String() != "10.0.0.1:7000" {
+			t.Fatalf("Expected local address 10.0.0.1:7000, got %v", rt.LocalAddr())
+		}
+
+		p, _ := NewPeer(rt.LocalAddr(), []uint8{0, 1})
+		rec := new(recorder)
+		if err = p.Serve(rt, uint64(time.Hour), 5, rec.handle, func(error) bool { return false }); err != nil {
+			t.Fatalf("Serve: %v", err)
+		}
+
+		select {
+		case <-rt.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Replay did not finish")
+		}
+		p.Close()
+
+		if err = rt.Err(); err != nil {
+			t.Fatalf("Replay failed: %v", err)
+		}
+
+		msgs := rec.take(MsgData)
+		if len(msgs) != 2 || string(msgs[0].data.([]uint8)) != "hello" || !bytes.Equal(msgs[1].data.([]uint8), big) {
+			t.Fatalf("Replayed messages do not match the capture")
+		}
+
+		if c := len(rec.take(MsgLatency)); c != 1 {
+			t.Fatalf("Expected the replayed pong to report latency, got %d reports", c)
+		}
+	}
+}
+
+// Writes captures to several writers.
+type multiCapture []CaptureWriter
+
+func (this multiCapture) WriteCapture(c *Capture) error {
+	for _, w := range this {
+		if err := w.WriteCapture(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestPcapClassic(t *testing.T) {
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 5000}
+	dst := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 7000}
+	data := []uint8{0, 2, 0, 0, 1, MsgData, 'h', 'i'}
+
+	packet := make([]uint8, 20+8+len(data))
+	putIPUDP(packet, src, dst, data)
+
+	// Big endian, microsecond timestamps, as written by tcpdump.
+	var buf bytes.Buffer
+	head := make([]uint8, 24)
+	binary.BigEndian.PutUint32(head[0:], pcapClassicMicro)
+	binary.BigEndian.PutUint16(head[4:], 2)
+	binary.BigEndian.PutUint16(head[6:], 4)
+	binary.BigEndian.PutUint32(head[16:], 65535)
+	binary.BigEndian.PutUint32(head[20:], pcapLinkTypeRaw)
+	buf.Write(head)
+
+	record := make([]uint8, 16)
+	binary.BigEndian.PutUint32(record[0:], 1e9)
+	binary.BigEndian.PutUint32(record[4:], 250000)
+	binary.BigEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.BigEndian.PutUint32(record[12:], uint32(len(packet)))
+	buf.Write(record)
+	buf.Write(packet)
+
+	compareCaptures(t, NewPcapReader(&buf), []*Capture{
+		{time.Unix(1e9, 250e6), true, dst, src, data},
+	})
+}
+
+func TestReplayClose(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewCaptureLogWriter(&buf)
+	w.WriteCapture(&Capture{
+		Time:    time.Unix(1e9, 0),
+		Inbound: true,
+		Local:   &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 7000},
+		Remote:  &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7000},
+		Data:    sealed(0, 2, 0, 0, 0, MsgData, 'x'),
+	})
+
+	rt, err := NewReplayTransport(NewCaptureLogReader(&buf), nil)
+	if err != nil {
+		t.Fatalf("NewReplayTransport: %v", err)
+	}
+
+	// Keep polling for a few errors, so ReadFrom is called again after
+	// the transport was closed.
+	var lock sync.Mutex
+	var errs []error
+	eh := func(err error) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		errs = append(errs, err)
+		return len(errs) >= 3
+	}
+
+	p, _ := NewPeer(rt.LocalAddr(), []uint8{0, 1})
+	rec := new(recorder)
+	if err = p.Serve(rt, uint64(time.Hour), 5, rec.handle, eh); err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+	defer p.Close()
+
+	select {
+	case <-rt.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Replay did not finish")
+	}
+
+	// Closed under the peer, rather than through Peer.Close.
+	rt.Close()
+
+	select {
+	case <-p.polled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Polling did not stop")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, err := range errs {
+		if err != net.ErrClosed {
+			t.Fatalf("Expected net.ErrClosed, got %v", err)
+		}
+	}
+
+	if c := len(rec.take(MsgData)); c != 1 {
+		t.Fatalf("Expected the replayed message, got %d", c)
+	}
+}
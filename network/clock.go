@@ -0,0 +1,157 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// This interface represents the source of time for a Peer. It is used for
+// packet timestamps, latency measurements, timeout detection and the periodic
+// ping requests. The default is SystemClock. Tests can use a ManualClock to
+// control the passing of time explicitly.
+type Clock interface {
+	// Returns the current time.
+	Now() time.Time
+
+	// Calls f every d until the returned stop function is called. Once stop
+	// returns, f is not running and will not be called again.
+	Every(d time.Duration, f func()) (stop func())
+
+	// Calls f once, after d has passed.
+	AfterFunc(d time.Duration, f func())
+}
+
+// The Clock used by peers unless another one is set through Peer.SetClock.
+var SystemClock Clock = systemClock{}
+
+// Clock implementation backed by the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) Every(d time.Duration, f func()) func() {
+	ticker := time.NewTicker(d)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		for {
+			select {
+			case <-ticker.C:
+				f()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-exited
+	}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) {
+	time.AfterFunc(d, f)
+}
+
+// A Clock which only moves when told to. Functions scheduled through Every are
+// run synchronously from within Advance, on the caller's goroutine. This means
+// that once Advance returns, every ping it triggered has been handed to the
+// transport.
+type ManualClock struct {
+	lock  sync.Mutex
+	now   time.Time
+	tasks []*clockTask
+}
+
+// A function scheduled with ManualClock.Every or ManualClock.AfterFunc.
+type clockTask struct {
+	next     time.Time
+	interval time.Duration // Zero for one-shot tasks.
+	f        func()
+}
+
+// Creates a new manual clock, set to the given time.
+func NewManualClock(start time.Time) *ManualClock {
+	c := new(ManualClock)
+	c.now = start
+	return c
+}
+
+func (this *ManualClock) Now() time.Time {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.now
+}
+
+func (this *ManualClock) Every(d time.Duration, f func()) func() {
+	if d <= 0 {
+		panic("network: non-positive interval for ManualClock.Every")
+	}
+
+	this.lock.Lock()
+	task := &clockTask{next: this.now.Add(d), interval: d, f: f}
+	this.tasks = append(this.tasks, task)
+	this.lock.Unlock()
+
+	return func() {
+		this.lock.Lock()
+		this.remove(task)
+		this.lock.Unlock()
+	}
+}
+
+func (this *ManualClock) AfterFunc(d time.Duration, f func()) {
+	this.lock.Lock()
+	this.tasks = append(this.tasks, &clockTask{next: this.now.Add(d), f: f})
+	this.lock.Unlock()
+}
+
+// Called with this.lock held.
+func (this *ManualClock) remove(task *clockTask) {
+	for i := range this.tasks {
+		if this.tasks[i] == task {
+			this.tasks = append(this.tasks[:i], this.tasks[i+1:]...)
+			return
+		}
+	}
+}
+
+// Moves the clock forward by d. Scheduled functions which come due in this
+// period are called in order, with the clock set to their due time. Functions
+// due at the same time are called in the order they were scheduled.
+func (this *ManualClock) Advance(d time.Duration) {
+	this.lock.Lock()
+	target := this.now.Add(d)
+
+	for {
+		var task *clockTask
+		for _, t := range this.tasks {
+			if !t.next.After(target) && (task == nil || t.next.Before(task.next)) {
+				task = t
+			}
+		}
+
+		if task == nil {
+			break
+		}
+
+		this.now = task.next
+		if task.interval == 0 {
+			this.remove(task)
+		} else {
+			task.next = task.next.Add(task.interval)
+		}
+
+		this.lock.Unlock()
+		task.f()
+		this.lock.Lock()
+	}
+
+	this.now = target
+	this.lock.Unlock()
+}
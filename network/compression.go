@@ -7,6 +7,16 @@ type Compressor interface {
 	Decompress(data []uint8) []uint8
 }
 
+// A Compressor which can write its output into a supplied buffer, can
+// implement this interface. The library then hands it pooled buffers, which
+// saves an allocation for every message. Both functions append their output
+// to dst and return the resulting slice, just like the append builtin.
+type AppendCompressor interface {
+	Compressor
+	AppendCompress(dst, data []uint8) []uint8
+	AppendDecompress(dst, data []uint8) []uint8
+}
+
 // A simple implementation of the network.Compressor interface.
 type GnarlyCompression struct{}
 
@@ -0,0 +1,133 @@
+package network
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Settings for Dial and Peer.ListenConfig. Any zero field takes on its
+// default value.
+type Config struct {
+	// Interval at which we ping the other side. Used to measure latency and
+	// to keep NAT mappings alive. Defaults to 10 seconds.
+	PingInterval time.Duration
+
+	// Time the other side can remain unresponsive before we consider it
+	// 'disconnected'. Defaults to 1 minute.
+	Timeout time.Duration
+
+	// Interval at which the handshake is repeated while Dial waits for an
+	// answer. Defaults to 250 milliseconds.
+	HandshakeInterval time.Duration
+
+	// 2 byte client id. Defaults to one derived from the local IP used to
+	// reach the server. Only used by Dial.
+	ClientId []uint8
+
+	// Source of time. Defaults to the clock set through Peer.SetClock, which
+	// itself defaults to SystemClock.
+	Clock Clock
+
+	// Socket to use. Defaults to a UDP socket. For Dial, this is bound to an
+	// ephemeral port. For Peer.ListenConfig, it is bound to Peer.Addr.
+	Transport Transport
+
+	// Maximum number of datagrams read or written with a single system call,
+	// on transports which support it (see BatchTransport). UDP sockets opened
+	// by this package, or handed to Peer.Serve, support batches on Linux.
+	// Defaults to 32. Set it to 1 to disable batching.
+	BatchSize int
+
+	// Number of goroutines which process incoming packets. Decryption and
+	// decompression then scale across cores. Packets are assigned to workers
+	// by sender, so packets from one peer are still processed in order, and
+	// never concurrently. Packets from different peers are, so with more than
+	// one worker, the MessageHandler must be safe for concurrent use. So must
+	// the ErrorHandler, which the workers call for the packets they drop.
+	// Note that MemoryNetwork.Step does not wait for workers to finish.
+	// Defaults to 1: all packets are processed on the polling goroutine.
+	Workers int
+
+	// Receives structured records about connecting and disconnecting peers,
+	// dropped packets and failed fragment reassemblies. Defaults to the
+	// logger set through Peer.SetLogger. Without one, nothing is logged.
+	Logger *slog.Logger
+
+	// Enables path MTU discovery (RFC 8899). The listener then probes the
+	// path to each peer with padded packets of increasing size, and
+	// fragments messages to the largest size which got through, rather
+	// than to PacketSize. Probes go out along with the pings. See
+	// Stats.PathMTU. Defaults to false.
+	PathMTU bool
+
+	// Largest datagram, without IP and UDP headers, which path MTU discovery
+	// probes for. It is also the largest one we can receive, whether or not
+	// discovery is enabled. Defaults to 1472: a 1500 byte Ethernet frame,
+	// less the IPv4 and UDP headers.
+	MaxDatagramSize int
+
+	// Creates the congestion controller of each peer, which limits the rate
+	// at which we send messages to it. See NewDelayController and
+	// NewAIMDController. Defaults to nil: sending is not limited.
+	Congestion func() CongestionController
+
+	// Bandwidth limits for the traffic with each peer, and for all of it
+	// together. Outbound packets are paced to stay below them: they leave
+	// spread out, rather than in bursts. Send fails with ErrSendRate once a
+	// message would have to wait longer than MaxSendDelay. Inbound packets
+	// beyond the limits are dropped, and reported as a *PacketError wrapping
+	// ErrReceiveRate. Defaults to no limits.
+	PeerLimits Limits
+	Limits     Limits
+
+	// Longest a message may wait for the send limits before it starts to
+	// leave. Defaults to 250 milliseconds.
+	MaxSendDelay time.Duration
+
+	// Receives every datagram read or written by the peer, as it appeared
+	// on the wire. See CaptureTransport, PcapWriter and CaptureLogWriter.
+	// Defaults to no capture.
+	Capture CaptureWriter
+}
+
+// Returns a copy of the config with all defaults filled in.
+func (this *Config) withDefaults() *Config {
+	c := new(Config)
+	if this != nil {
+		*c = *this
+	}
+
+	if c.PingInterval <= 0 {
+		c.PingInterval = 10 * time.Second
+	}
+
+	if c.Timeout <= 0 {
+		c.Timeout = time.Minute
+	}
+
+	if c.HandshakeInterval <= 0 {
+		c.HandshakeInterval = 250 * time.Millisecond
+	}
+
+	if c.BatchSize <= 0 {
+		c.BatchSize = 32
+	}
+
+	if c.MaxDatagramSize <= 0 {
+		c.MaxDatagramSize = defaultDatagramSize
+	}
+
+	if c.MaxSendDelay <= 0 {
+		c.MaxSendDelay = defaultSendDelay
+	}
+	return c
+}
+
+// Returns the timeout in whole seconds, as used by Peer.Serve.
+func (this *Config) timeoutSeconds() uint16 {
+	s := (this.Timeout + time.Second - 1) / time.Second
+	if s > 65535 {
+		s = 65535
+	}
+	return uint16(s)
+}
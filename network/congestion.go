@@ -0,0 +1,316 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// This interface limits the rate at which we send messages to a peer. Each
+// peer gets its own instance from Config.Congestion. The listener feeds it the
+// measurements of every ping exchange with the peer, and the controller
+// answers with the rate at which messages may be sent.
+//
+// Games rarely fill the link, so controllers should only raise the rate when
+// the game actually used a good part of it. See CongestionSample.Throughput.
+type CongestionController interface {
+	// Takes the measurements of one ping exchange.
+	Update(s CongestionSample)
+
+	// Returns the allowed rate in bytes per second, including packet headers.
+	Rate() int
+}
+
+// The measurements of one ping exchange with a peer, handed to its
+// CongestionController.
+type CongestionSample struct {
+	RTT        time.Duration // Round trip time of the exchange.
+	Loss       float64       // Fraction [0-1] of our recent packets the peer did not receive. See Stats.LossOut.
+	Throughput int           // Bytes per second we sent to the peer since the previous sample.
+}
+
+// Default bounds of the rate, in bytes per second, of the controllers in this
+// package.
+const (
+	DefaultMinRate   = 4 << 10
+	DefaultStartRate = 128 << 10
+	DefaultMaxRate   = 10 << 20
+)
+
+// A delay based congestion controller, in the spirit of LEDBAT (RFC 6817). It
+// keeps the queueing delay it causes, the round trip time above the lowest one
+// seen recently, below a target. That is the signal which matters to games:
+// the rate drops as soon as the player's upstream link starts to queue our
+// packets, well before they are lost. Loss still cuts the rate, in case the
+// delay does not show it.
+type DelayController struct {
+	MinRate int           // Defaults to DefaultMinRate.
+	MaxRate int           // Defaults to DefaultMaxRate.
+	Target  time.Duration // Queueing delay we allow. Defaults to 25ms.
+	Loss    float64       // Loss above which the rate is cut. Defaults to 10%.
+
+	rate  float64
+	base  [10]time.Duration // Lowest round trip time of the last samples.
+	count int               // Number of samples taken so far.
+	loss  float64           // Loss of the previous sample.
+}
+
+// Creates a delay based controller, which starts at DefaultStartRate. A zero
+// DelayController is ready to use as well.
+func NewDelayController() *DelayController {
+	c := new(DelayController)
+	c.defaults()
+	return c
+}
+
+// Fills in the fields left zero, and starts the rate.
+func (this *DelayController) defaults() {
+	if this.MinRate == 0 {
+		this.MinRate = DefaultMinRate
+	}
+	if this.MaxRate == 0 {
+		this.MaxRate = DefaultMaxRate
+	}
+	if this.Target == 0 {
+		this.Target = 25 * time.Millisecond
+	}
+	if this.Loss == 0 {
+		this.Loss = 0.1
+	}
+	if this.rate == 0 {
+		this.rate = clampRate(DefaultStartRate, this.MinRate, this.MaxRate)
+	}
+}
+
+func (this *DelayController) Update(s CongestionSample) {
+	this.defaults()
+
+	this.base[this.count%len(this.base)] = s.RTT
+	this.count++
+
+	base := s.RTT
+	for i := 0; i < len(this.base) && i < this.count; i++ {
+		if this.base[i] < base {
+			base = this.base[i]
+		}
+	}
+
+	// The further the delay is off target, the larger the step, as in
+	// LEDBAT. Below the target, the rate only grows while it is in use.
+	off := float64(this.Target-(s.RTT-base)) / float64(this.Target)
+	if off < -1 {
+		off = -1
+	}
+
+	switch {
+	case lossRising(s.Loss, this.loss, this.Loss):
+		this.rate /= 2
+	case off < 0:
+		this.rate *= 1 + off/4
+	case float64(s.Throughput) >= this.rate/2:
+		this.rate *= 1 + off/8
+	}
+
+	this.loss = s.Loss
+	this.rate = clampRate(this.rate, this.MinRate, this.MaxRate)
+}
+
+func (this *DelayController) Rate() int {
+	this.defaults()
+	return int(this.rate)
+}
+
+// An additive increase, multiplicative decrease controller, like TCP's. It
+// only reacts to loss, so it lets queues build up, but it needs no usable
+// delay measurements.
+type AIMDController struct {
+	MinRate  int     // Defaults to DefaultMinRate.
+	MaxRate  int     // Defaults to DefaultMaxRate.
+	Increase int     // Bytes per second added with every sample without loss. Defaults to 8KB/s.
+	Decrease float64 // Factor applied on loss. Defaults to 0.5.
+	Loss     float64 // Loss above which the rate is cut. Defaults to 2%.
+
+	rate float64
+	loss float64 // Loss of the previous sample.
+}
+
+// Creates an AIMD controller, which starts at DefaultStartRate. A zero
+// AIMDController is ready to use as well.
+func NewAIMDController() *AIMDController {
+	c := new(AIMDController)
+	c.defaults()
+	return c
+}
+
+// Fills in the fields left zero, and starts the rate.
+func (this *AIMDController) defaults() {
+	if this.MinRate == 0 {
+		this.MinRate = DefaultMinRate
+	}
+	if this.MaxRate == 0 {
+		this.MaxRate = DefaultMaxRate
+	}
+	if this.Increase == 0 {
+		this.Increase = 8 << 10
+	}
+	if this.Decrease == 0 {
+		this.Decrease = 0.5
+	}
+	if this.Loss == 0 {
+		this.Loss = 0.02
+	}
+	if this.rate == 0 {
+		this.rate = clampRate(DefaultStartRate, this.MinRate, this.MaxRate)
+	}
+}
+
+func (this *AIMDController) Update(s CongestionSample) {
+	this.defaults()
+
+	switch {
+	case lossRising(s.Loss, this.loss, this.Loss):
+		this.rate *= this.Decrease
+	case float64(s.Throughput) >= this.rate/2:
+		this.rate += float64(this.Increase)
+	}
+
+	this.loss = s.Loss
+	this.rate = clampRate(this.rate, this.MinRate, this.MaxRate)
+}
+
+func (this *AIMDController) Rate() int {
+	this.defaults()
+	return int(this.rate)
+}
+
+// Reports whether loss is above the threshold, and not on its way down. The
+// loss reports cover the last 256 packets, so they lag behind: a loss which
+// got cut already lingers in the next few reports.
+func lossRising(loss, previous, threshold float64) bool {
+	return loss > threshold && loss >= previous
+}
+
+func clampRate(rate float64, min, max int) float64 {
+	if rate > float64(max) {
+		rate = float64(max)
+	}
+	if rate < float64(min) {
+		rate = float64(min)
+	}
+	return rate
+}
+
+// A token bucket. Tokens are bytes, which accrue at the given rate up to
+// burst bytes.
+type tokenBucket struct {
+	rate   float64 // Bytes per second.
+	burst  float64
+	tokens float64
+	last   int64 // Time of the last refill, in nanoseconds.
+}
+
+// Takes n bytes from the bucket at time now. The bucket may go into debt, so
+// a message larger than the burst can still be sent: it returns false only
+// while the bucket is empty.
+func (this *tokenBucket) take(now int64, n int) bool {
+	if now > this.last {
+		this.tokens += this.rate * float64(now-this.last) / 1e9
+		if this.tokens > this.burst {
+			this.tokens = this.burst
+		}
+	}
+	this.last = now
+
+	if this.tokens <= 0 {
+		return false
+	}
+
+	this.tokens -= float64(n)
+	return true
+}
+
+// Period whose worth of data the send rate allows in one burst.
+const congestionBurst = 100 * time.Millisecond
+
+// The congestion control state of a peer.
+type congestion struct {
+	lock   sync.Mutex
+	ctl    CongestionController // nil if there is no limit.
+	bucket tokenBucket
+	sent   int   // Bytes sent since the last sample.
+	last   int64 // Time of the last sample, in nanoseconds.
+}
+
+// Enables congestion control with the given controller.
+func (this *congestion) start(ctl CongestionController, now int64) {
+	this.lock.Lock()
+	this.ctl = ctl
+	this.last = now
+	this.bucket.last = now
+	this.limit()
+	this.bucket.tokens = this.bucket.burst
+	this.lock.Unlock()
+}
+
+// Sets the bucket to the controller's rate. Called with the lock held.
+func (this *congestion) limit() {
+	this.bucket.rate = float64(this.ctl.Rate())
+	this.bucket.burst = this.bucket.rate * congestionBurst.Seconds()
+}
+
+// Returns whether a message of n bytes may be sent at time now, and counts it
+// if so.
+func (this *congestion) admit(now int64, n int) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.ctl == nil {
+		return true
+	}
+
+	if !this.bucket.take(now, n) {
+		return false
+	}
+
+	this.sent += n
+	return true
+}
+
+// Hands the measurements of a ping exchange to the controller.
+func (this *congestion) update(now int64, rtt time.Duration, loss float64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.ctl == nil {
+		return
+	}
+
+	s := CongestionSample{RTT: rtt, Loss: loss}
+	if now > this.last {
+		s.Throughput = int(float64(this.sent) * 1e9 / float64(now-this.last))
+	}
+
+	this.ctl.Update(s)
+	this.limit()
+	this.sent = 0
+	this.last = now
+}
+
+// Returns the allowed rate in bytes per second. 0 means unlimited.
+func (this *congestion) rate() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.ctl == nil {
+		return 0
+	}
+	return this.ctl.Rate()
+}
+
+// Returns the rate in bytes per second at which messages may be sent to this
+// peer, as set by the congestion controller (see Config.Congestion). Send
+// fails with ErrSendRate while it is exceeded. It is updated with every ping
+// exchange, right before the MsgLatency message, so that is a good moment for
+// a game to adapt its update frequency. 0 means unlimited.
+func (this *Peer) SendRate() int {
+	return this.cc.rate()
+}
@@ -0,0 +1,189 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelayController(t *testing.T) {
+	c := NewDelayController()
+	busy := func(rtt time.Duration, loss float64) int {
+		c.Update(CongestionSample{RTT: rtt, Loss: loss, Throughput: c.Rate()})
+		return c.Rate()
+	}
+
+	// Below the target delay, a busy link speeds up.
+	rate := c.Rate()
+	for i := 0; i < 5; i++ {
+		if r := busy(50*time.Millisecond, 0); r <= rate {
+			t.Fatalf("Expected the rate to grow from %d, got %d", rate, r)
+		} else {
+			rate = r
+		}
+	}
+
+	// An idle one does not.
+	c.Update(CongestionSample{RTT: 50 * time.Millisecond})
+	if r := c.Rate(); r != rate {
+		t.Fatalf("Expected the rate to hold at %d while idle, got %d", rate, r)
+	}
+
+	// Queueing delay well above the target slows it down, before any loss.
+	for i := 0; i < 5; i++ {
+		if r := busy(150*time.Millisecond, 0); r >= rate {
+			t.Fatalf("Expected the rate to drop from %d, got %d", rate, r)
+		} else {
+			rate = r
+		}
+	}
+
+	// The delay recovers, but loss halves the rate. Reports of the same loss
+	// going down afterwards do not.
+	busy(50*time.Millisecond, 0)
+	rate = c.Rate()
+	if r := busy(50*time.Millisecond, 0.2); r != rate/2 {
+		t.Fatalf("Expected loss to halve the rate to %d, got %d", rate/2, r)
+	}
+
+	rate = c.Rate()
+	if r := busy(50*time.Millisecond, 0.15); r < rate {
+		t.Fatalf("Expected lingering loss to be ignored, got %d, from %d", r, rate)
+	}
+
+	for i := 0; i < 100; i++ {
+		busy(50*time.Millisecond, 0.5)
+	}
+	if r := c.Rate(); r != DefaultMinRate {
+		t.Fatalf("Expected the rate to bottom out at %d, got %d", DefaultMinRate, r)
+	}
+}
+
+func TestAIMDController(t *testing.T) {
+	c := NewAIMDController()
+
+	c.Update(CongestionSample{Throughput: DefaultStartRate})
+	if r := c.Rate(); r != DefaultStartRate+8<<10 {
+		t.Fatalf("Expected an additive increase, got %d", r)
+	}
+
+	c.Update(CongestionSample{Throughput: 0})
+	if r := c.Rate(); r != DefaultStartRate+8<<10 {
+		t.Fatalf("Expected no increase while idle, got %d", r)
+	}
+
+	c.Update(CongestionSample{Loss: 0.05})
+	if r := c.Rate(); r != (DefaultStartRate+8<<10)/2 {
+		t.Fatalf("Expected a multiplicative decrease, got %d", r)
+	}
+
+	c.MaxRate = 100 << 10
+	c.Update(CongestionSample{Throughput: 1 << 20})
+	c.Update(CongestionSample{Throughput: 1 << 20})
+	if r := c.Rate(); r != 84<<10 {
+		t.Fatalf("Expected %d, got %d", 84<<10, r)
+	}
+}
+
+func TestControllerZero(t *testing.T) {
+	for _, c := range []CongestionController{&DelayController{}, &AIMDController{}} {
+		if r := c.Rate(); r != DefaultStartRate {
+			t.Fatalf("%T: Expected to start at %d, got %d", c, DefaultStartRate, r)
+		}
+
+		c.Update(CongestionSample{RTT: 50 * time.Millisecond, Throughput: c.Rate()})
+		if r := c.Rate(); r <= DefaultStartRate || r > DefaultMaxRate {
+			t.Fatalf("%T: Expected the rate to grow from %d, got %d", c, DefaultStartRate, r)
+		}
+	}
+
+	// Fields which are set are kept.
+	c := &AIMDController{MaxRate: 64 << 10}
+	if r := c.Rate(); r != 64<<10 {
+		t.Fatalf("Expected to start at the maximum of %d, got %d", 64<<10, r)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := tokenBucket{rate: 1000, burst: 100, tokens: 100}
+
+	// The burst, and a message which takes the bucket into debt.
+	if !b.take(0, 60) || !b.take(0, 60) || b.take(0, 1) {
+		t.Fatalf("Expected 2 messages in the burst")
+	}
+
+	// The debt of 20 bytes is paid back after 20ms.
+	if b.take(int64(20*time.Millisecond), 1) || !b.take(int64(21*time.Millisecond), 1) {
+		t.Fatalf("Expected the bucket to refill at 1000 bytes/s")
+	}
+
+	// Tokens do not accrue beyond the burst.
+	b.take(int64(10*time.Second), 0)
+	if b.tokens != 100 {
+		t.Fatalf("Expected a full bucket of 100, got %v", b.tokens)
+	}
+}
+
+func TestCongestionSend(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	var peers []*Peer
+	var sims []*SimulatedTransport
+	for i, addr := range []string{"10.0.0.1:7000", "10.0.0.2:7000"} {
+		cfg, sim := simulated(clock)
+		sim.Seed(1)
+		cfg.ErrorHandler = ignoreErrors
+		cfg.Congestion = func() CongestionController { return NewAIMDController() }
+
+		p, _ := newMemoryPeer(t, n, clock, addr, uint8(i+1), nil, cfg)
+		defer p.Close()
+
+		peers = append(peers, p)
+		sims = append(sims, sim)
+	}
+
+	a, b := peers[0], peers[1]
+	b.SendTo(a.Addr, []uint8("hello"))
+	n.Flush()
+
+	client := a.GetClient(b.Id)
+	if r := client.Stats().SendRate; r != DefaultStartRate {
+		t.Fatalf("Expected to start at %d bytes/s, got %d", DefaultStartRate, r)
+	}
+
+	// Sends 1KB messages until the controller objects.
+	burst := func() (sent int) {
+		data := make([]uint8, 1000)
+		for ; sent < 1000; sent++ {
+			if err := client.Send(data); err == ErrSendRate {
+				break
+			} else if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+		}
+		n.Flush()
+		return
+	}
+
+	// 100ms worth of the rate, plus one message which goes into debt. Each
+	// message takes 1011 bytes on the wire.
+	if c := burst(); c != DefaultStartRate/10/1011+1 {
+		t.Fatalf("Expected %d messages, got %d", DefaultStartRate/10/1011+1, c)
+	}
+
+	clock.Advance(50 * time.Millisecond)
+	if c := burst(); c == 0 || c > DefaultStartRate/20/1011+1 {
+		t.Fatalf("Expected up to %d messages after 50ms, got %d", DefaultStartRate/20/1011+1, c)
+	}
+
+	// Half of our packets get lost. The peer reports it, and we slow down.
+	sims[0].SetOutbound(Conditions{Loss: 0.5})
+	for i := 0; i < 10; i++ {
+		clock.Advance(100 * time.Millisecond)
+		burst()
+	}
+
+	if r := client.SendRate(); r >= DefaultStartRate {
+		t.Fatalf("Expected the rate to drop below %d, got %d", DefaultStartRate, r)
+	}
+}
@@ -0,0 +1,218 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// A client connection to a server, created with Dial. This is the regular
+// client/server counterpart of the symmetric Peer.Listen model: the client
+// only talks to one server, from a socket on an ephemeral port.
+type Conn struct {
+	local     *Peer         // Our own peer. It owns the socket.
+	server    *Peer         // The server, as known to local. Set once the handshake completes.
+	addr      *net.UDPAddr  // Server address.
+	lock      sync.Mutex    // Guards the fields below.
+	incoming  [][]byte      // Received data which has not been picked up by Receive yet.
+	err       error         // Set once the connection is no longer usable.
+	attempts  int           // Number of handshake packets sent.
+	signal    chan struct{} // Wakes up Receive.
+	connected chan struct{} // Closed when the handshake completes.
+	failed    chan struct{} // Closed when err is set.
+}
+
+// Connects to the server at the given address. It binds a socket on an
+// ephemeral port and repeats the handshake until the server answers, or until
+// ctx expires. Once connected, both sides ping each other to measure latency
+// and keep NAT mappings alive. If the server remains silent for longer than
+// the configured timeout, the connection fails with ErrTimeout. If the server
+// speaks another protocol version, Dial fails with ErrVersionMismatch.
+//
+// A nil config uses the defaults.
+func Dial(ctx context.Context, address string, cfg *Config) (c *Conn, err error) {
+	cfg = cfg.withDefaults()
+
+	c = new(Conn)
+	c.signal = make(chan struct{}, 1)
+	c.connected = make(chan struct{})
+	c.failed = make(chan struct{})
+
+	if c.addr, err = net.ResolveUDPAddr("udp", address); err != nil {
+		return nil, err
+	}
+
+	clientid := cfg.ClientId
+	if clientid == nil {
+		if clientid, err = clientIdFor(c.addr); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.local, err = NewPeer(c.addr, clientid); err != nil {
+		return nil, err
+	}
+
+	t := cfg.Transport
+	if t == nil {
+		var conn *net.UDPConn
+		if conn, err = net.ListenUDP("udp", nil); err != nil {
+			return nil, err
+		}
+		t = conn
+	}
+
+	mh := func(p *Peer, msgtype uint8, data interface{}) { c.onMessage(p, msgtype, data) }
+	eh := func(err error) bool { c.onError(err); return false }
+
+	if err = c.local.serve(t, cfg, mh, eh); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	handshake := func() {
+		c.lock.Lock()
+		c.attempts++
+		c.lock.Unlock()
+		c.local.send(c.local, c.addr, nil, MsgConnect)
+	}
+	handshake()
+	stop := c.local.clock.Every(cfg.HandshakeInterval, handshake)
+	defer stop()
+
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.failed:
+		c.local.Close()
+		return nil, c.err
+	case <-ctx.Done():
+		c.local.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Sends data to the server.
+func (this *Conn) Send(data []uint8) error {
+	this.lock.Lock()
+	err := this.err
+	this.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return this.server.Send(data)
+}
+
+// Blocks until data from the server arrives, the connection fails, or ctx
+// expires.
+func (this *Conn) Receive(ctx context.Context) ([]uint8, error) {
+	for {
+		this.lock.Lock()
+		if len(this.incoming) > 0 {
+			data := this.incoming[0]
+			this.incoming[0] = nil
+			this.incoming = this.incoming[1:]
+			this.lock.Unlock()
+			return data, nil
+		}
+
+		err := this.err
+		this.lock.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-this.signal:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Closes the connection. Pending and future calls to Receive and Send fail
+// with ErrConnectionClosed.
+func (this *Conn) Close() error {
+	this.fail(ErrConnectionClosed)
+	this.local.Close()
+	return nil
+}
+
+// Returns the server, as known to our local peer. It holds the server's
+// sequence counters and connection statistics.
+func (this *Conn) Server() *Peer { return this.server }
+
+// Returns the current time on the server's clock, as estimated from ours. See
+// Peer.ServerTime.
+func (this *Conn) ServerTime() time.Time { return this.server.ServerTime() }
+
+// Returns the address of our socket.
+func (this *Conn) LocalAddr() net.Addr { return this.local.LocalAddr() }
+
+// Returns the address of the server.
+func (this *Conn) RemoteAddr() net.Addr { return this.addr }
+
+func (this *Conn) onMessage(p *Peer, msgtype uint8, data interface{}) {
+	switch msgtype {
+	case MsgPeerConnected:
+		if p.Addr.String() == this.addr.String() {
+			this.lock.Lock()
+			if this.server == nil {
+				this.server = p
+				p.stats.retransmitted(this.attempts - 1)
+				close(this.connected)
+			}
+			this.lock.Unlock()
+		}
+
+	case MsgPeerDisconnected:
+		if p == this.server {
+			this.fail(ErrTimeout)
+		}
+
+	case MsgLatency:
+		// Available through Server().Stats().
+
+	default:
+		if p != this.server {
+			return // Not from our server.
+		}
+
+		// The data is only valid during this call.
+		this.lock.Lock()
+		this.incoming = append(this.incoming, Retain(data.([]uint8)))
+		this.lock.Unlock()
+		this.wake()
+	}
+}
+
+// A server of another protocol version rejects our packets. That makes the
+// connection unusable.
+func (this *Conn) onError(err error) {
+	var pe *PacketError
+	if errors.As(err, &pe) && pe.Err == ErrVersionMismatch && pe.Addr.String() == this.addr.String() {
+		this.fail(ErrVersionMismatch)
+	}
+}
+
+// Marks the connection as no longer usable. Only the first error sticks.
+func (this *Conn) fail(err error) {
+	this.lock.Lock()
+	if this.err == nil {
+		this.err = err
+		close(this.failed)
+	}
+	this.lock.Unlock()
+	this.wake()
+}
+
+func (this *Conn) wake() {
+	select {
+	case this.signal <- struct{}{}:
+	default:
+	}
+}
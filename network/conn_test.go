@@ -0,0 +1,150 @@
+package network
+
+import "testing"
+import "time"
+import "context"
+
+func TestDial(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	// Echo everything back to the sender.
+	echo := func(p *Peer, msgtype uint8, data interface{}) {
+		if msgtype == MsgData {
+			p.Send(data.([]byte))
+		}
+	}
+
+	server, _ := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, echo, nil)
+
+	tr, err := n.Listen("10.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{
+		PingInterval: time.Second,
+		Timeout:      5 * time.Second,
+		ClientId:     []uint8{0, 2},
+		Clock:        clock,
+		Transport:    tr,
+	}
+
+	type result struct {
+		c   *Conn
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		c, err := Dial(context.Background(), "10.0.0.1:7000", cfg)
+		done <- result{c, err}
+	}()
+
+	// The first handshake may not have been sent yet. Keep the retries coming.
+	var res result
+	for res.c == nil && res.err == nil {
+		n.Flush()
+		select {
+		case res = <-done:
+		case <-time.After(time.Millisecond):
+			clock.Advance(cfg.HandshakeInterval)
+		}
+	}
+
+	if res.err != nil {
+		t.Fatalf("Dial: %v", res.err)
+	}
+
+	c := res.c
+	defer c.Close()
+
+	if err = c.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	n.Flush()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	data, err := c.Receive(ctx)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Receive: %q, %v", data, err)
+	}
+
+	// The server goes away. Our pings go unanswered until we time out.
+	server.Close()
+	clock.Advance(6 * time.Second)
+	n.Flush()
+
+	if _, err = c.Receive(ctx); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestDialVersionMismatch(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	// A server of the next protocol version. It answers everything, but
+	// leaves rejections alone.
+	server, err := n.Listen("10.0.0.1:7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	rejected := make(chan struct{}, 1)
+	go func() {
+		b := make([]uint8, PacketSize)
+		for {
+			size, addr, err := server.ReadFrom(b)
+			if err != nil {
+				return
+			}
+
+			if Packet(append(make([]uint8, 16), b[:size]...)).Flags()&PFReject != 0 {
+				select {
+				case rejected <- struct{}{}:
+				default:
+				}
+				continue
+			}
+
+			server.WriteTo(sealVersion(sealed(0, 1, 0, 0, 0, MsgAccept), ProtocolVersion+1), addr)
+		}
+	}()
+
+	tr, err := n.Listen("10.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{ClientId: []uint8{0, 2}, Clock: clock, Transport: tr}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Dial(context.Background(), "10.0.0.1:7000", cfg)
+		done <- err
+	}()
+
+	for err == nil {
+		n.Flush()
+		select {
+		case err = <-done:
+		case <-time.After(time.Millisecond):
+			clock.Advance(cfg.HandshakeInterval)
+		}
+	}
+
+	if err != ErrVersionMismatch {
+		t.Fatalf("Expected ErrVersionMismatch, got %v", err)
+	}
+
+	select {
+	case <-rejected:
+	default:
+		t.Fatalf("The client did not reject the server's packets")
+	}
+}
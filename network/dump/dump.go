@@ -0,0 +1,363 @@
+// Package dump decodes captured gnarly datagrams into readable text: packet
+// headers, fragment groups, message types and payloads. It is the engine of
+// the gnarly-dump command, which reads datagrams from hex dumps, capture logs,
+// pcap files or a live socket.
+//
+//	d := dump.New(os.Stdout)
+//	for {
+//		c, err := reader.ReadCapture()
+//		if err != nil {
+//			break
+//		}
+//		d.Dump(c)
+//	}
+//	d.Flush()
+//
+// Payloads are decrypted and decompressed with network.Encryption and
+// network.Compression, unless other codecs are set on the Dumper. Programs
+// which use their own codecs can build their own dump command around Main.
+package dump
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/snuk182/gnarly/network"
+)
+
+// Decodes datagrams and writes them to an io.Writer.
+type Dumper struct {
+	Compression network.Compressor // Defaults to network.Compression.
+	Encryption  network.Encrypter  // Defaults to network.Encryption.
+	Hex         bool               // Show payloads as a hex dump, rather than as quoted text.
+	MaxData     int                // Maximum number of payload bytes shown. 0 shows all of it.
+
+	w      io.Writer
+	peers  map[string]string // Peer ids by address, learnt from inbound packets.
+	groups map[string]*group // Fragments waiting for the rest of their message.
+}
+
+// The fragments of one message, sent by one peer.
+type group struct {
+	base  network.Seq // Sequence number of the first fragment.
+	flags uint8
+	parts [][]uint8
+}
+
+func (this *group) received() (n int) {
+	for _, p := range this.parts {
+		if p != nil {
+			n++
+		}
+	}
+	return
+}
+
+func New(w io.Writer) *Dumper {
+	d := new(Dumper)
+	d.Compression = network.Compression
+	d.Encryption = network.Encryption
+	d.MaxData = 256
+	d.w = w
+	d.peers = make(map[string]string)
+	d.groups = make(map[string]*group)
+	return d
+}
+
+// Writes the decoded form of a captured datagram.
+func (this *Dumper) Dump(c *network.Capture) {
+	dir, src, dst := "in", c.Remote, c.Local
+	if !c.Inbound {
+		dir, src, dst = "out", c.Local, c.Remote
+	}
+
+	stamp := "-"
+	if !c.Time.IsZero() {
+		stamp = c.Time.UTC().Format(time.RFC3339Nano)
+	}
+
+	fmt.Fprintf(this.w, "%s %s %s > %s, %d bytes\n", stamp, dir, addr(src), addr(dst), len(c.Data))
+
+	if len(c.Data) < network.HeaderSize+network.TrailerSize {
+		fmt.Fprintf(this.w, "  invalid: packet too short\n")
+		return
+	}
+
+	version, ok := network.Unseal(c.Data)
+	if !ok {
+		fmt.Fprintf(this.w, "  invalid: checksum mismatch\n")
+		return
+	}
+
+	// The header of another version may not be ours.
+	if version != network.ProtocolVersion {
+		fmt.Fprintf(this.w, "  protocol version %d, expected %d\n", version, network.ProtocolVersion)
+		return
+	}
+
+	size := len(c.Data) - network.TrailerSize
+	packet := make(network.Packet, 16+size)
+	copy(packet[16:], c.Data)
+
+	flags := packet.Flags()
+	if flags&network.PFFragmented != 0 && size < network.FragmentHeaderSize {
+		fmt.Fprintf(this.w, "  invalid: fragment header too short\n")
+		return
+	}
+
+	peer := this.peer(c, packet)
+	s1, s2 := packet.SubSequence()
+	id := packet.ClientId()
+
+	fmt.Fprintf(this.w, "  [%03d/%03d] | 0x%02x%s | 0x%04x | %02x %02x | peer %s\n",
+		s1, s2, flags, flagNames(flags), packet.Sequence(), id[0], id[1], peerName(peer))
+
+	if flags&network.PFReject != 0 {
+		fmt.Fprintf(this.w, "  reject: the receiver speaks another protocol version\n")
+		return
+	}
+
+	data := packet.Data()
+	if flags&network.PFFragmented != 0 {
+		var ok bool
+		if data, ok = this.reassemble(dir+" "+addr(src)+" "+hex.EncodeToString(id), packet); !ok {
+			return
+		}
+	}
+
+	this.message(peer, flags, data)
+}
+
+// Reports the messages which are still missing fragments. Call this at the
+// end of a capture.
+func (this *Dumper) Flush() {
+	for key, g := range this.groups {
+		fmt.Fprintf(this.w, "%s: incomplete message at seq 0x%04x, got %d of %d fragments\n",
+			key, g.base, g.received(), len(g.parts))
+		delete(this.groups, key)
+	}
+}
+
+// Returns the id of the peer on the other side of the datagram, or an empty
+// string if it is not known. The id is what the Encrypter is handed.
+func (this *Dumper) peer(c *network.Capture, packet network.Packet) string {
+	if c.Remote == nil {
+		return ""
+	}
+
+	if !c.Inbound {
+		return this.peers[c.Remote.String()]
+	}
+
+	p, err := network.NewPeer(c.Remote, packet.ClientId())
+	if err != nil {
+		return ""
+	}
+
+	this.peers[c.Remote.String()] = p.Id
+	return p.Id
+}
+
+// Adds a fragment to its group. Returns the reassembled message once all
+// fragments have been seen, the same way a Peer does.
+func (this *Dumper) reassemble(key string, packet network.Packet) ([]uint8, bool) {
+	s1, s2 := packet.SubSequence()
+	if s1 >= s2 {
+		fmt.Fprintf(this.w, "  invalid: fragment index out of range\n")
+		return nil, false
+	}
+
+	base := packet.Sequence() - network.Seq(s1)
+
+	g := this.groups[key]
+	if g != nil && base.Less(g.base) {
+		fmt.Fprintf(this.w, "  stale fragment %d of %d of message at seq 0x%04x\n", s1+1, s2, base)
+		return nil, false
+	}
+
+	if g != nil && (g.base != base || len(g.parts) != int(s2)) {
+		fmt.Fprintf(this.w, "  reassembly failed: message at seq 0x%04x got %d of %d fragments\n",
+			g.base, g.received(), len(g.parts))
+		g = nil
+	}
+
+	if g == nil {
+		g = &group{base: base, parts: make([][]uint8, s2)}
+		this.groups[key] = g
+	}
+
+	g.flags = packet.Flags()
+	g.parts[s1] = append([]uint8(nil), packet.Data()...)
+
+	if n := g.received(); n < len(g.parts) {
+		fmt.Fprintf(this.w, "  fragment %d of %d of message at seq 0x%04x\n", s1+1, s2, base)
+		return nil, false
+	}
+
+	delete(this.groups, key)
+
+	var data []uint8
+	for _, p := range g.parts {
+		data = append(data, p...)
+	}
+
+	fmt.Fprintf(this.w, "  reassembled %d fragments (seq 0x%04x-0x%04x), %d bytes\n",
+		len(g.parts), base, base+network.Seq(len(g.parts)-1), len(data))
+	return data, true
+}
+
+// Decrypts, decompresses and describes a message.
+func (this *Dumper) message(peer string, flags uint8, data []uint8) {
+	if flags&network.PFEncrypted != 0 {
+		if this.Encryption == nil {
+			fmt.Fprintf(this.w, "  encrypted, %d bytes\n", len(data))
+			this.payload(data)
+			return
+		}
+		data = this.Encryption.Decrypt(peer, data)
+	}
+
+	if flags&network.PFCompressed != 0 {
+		if this.Compression == nil {
+			fmt.Fprintf(this.w, "  compressed, %d bytes\n", len(data))
+			this.payload(data)
+			return
+		}
+		data = this.Compression.Decompress(data)
+	}
+
+	if len(data) == 0 {
+		fmt.Fprintf(this.w, "  invalid: no data\n")
+		return
+	}
+
+	msgtype, data := data[0], data[1:]
+	fmt.Fprintf(this.w, "  %s, %d bytes", typeName(msgtype), len(data))
+
+	switch msgtype {
+	case network.MsgPing:
+		if len(data) < 8 {
+			fmt.Fprintf(this.w, ", truncated\n")
+			return
+		}
+
+		fmt.Fprintf(this.w, ": sent %s", timestamp(data))
+		if len(data) >= 10 {
+			fmt.Fprintf(this.w, ", loss %s", loss(data[8:]))
+		}
+		fmt.Fprintln(this.w)
+
+	case network.MsgPong:
+		if len(data) < 8 {
+			fmt.Fprintf(this.w, ", truncated\n")
+			return
+		}
+
+		fmt.Fprintf(this.w, ": ping sent %s", timestamp(data))
+		if len(data) >= 10 {
+			fmt.Fprintf(this.w, ", loss %s", loss(data[8:]))
+		}
+		if len(data) >= 26 {
+			fmt.Fprintf(this.w, ", received %s, sent %s", timestamp(data[10:]), timestamp(data[18:]))
+		}
+		fmt.Fprintln(this.w)
+
+	case network.MsgConnect, network.MsgAccept:
+		fmt.Fprintln(this.w)
+
+	case network.MsgProbe, network.MsgProbeAck:
+		if len(data) < 2 {
+			fmt.Fprintf(this.w, ", truncated\n")
+			return
+		}
+		fmt.Fprintf(this.w, ": path MTU %d\n", int(data[0])<<8|int(data[1]))
+
+	default:
+		fmt.Fprintln(this.w)
+		this.payload(data)
+	}
+}
+
+// Writes a payload, truncated to MaxData bytes.
+func (this *Dumper) payload(data []uint8) {
+	if len(data) == 0 {
+		return
+	}
+
+	more := ""
+	if this.MaxData > 0 && len(data) > this.MaxData {
+		more = fmt.Sprintf("  ... %d more bytes\n", len(data)-this.MaxData)
+		data = data[:this.MaxData]
+	}
+
+	if this.Hex {
+		for _, line := range strings.SplitAfter(strings.TrimSuffix(hex.Dump(data), "\n"), "\n") {
+			fmt.Fprintf(this.w, "    %s", line)
+		}
+		fmt.Fprintln(this.w)
+	} else {
+		fmt.Fprintf(this.w, "    %q\n", data)
+	}
+
+	fmt.Fprint(this.w, more)
+}
+
+func typeName(t uint8) string {
+	for _, mt := range network.MessageTypes {
+		if mt.Value == t {
+			return mt.Name
+		}
+	}
+
+	if t >= network.MsgMax {
+		return fmt.Sprintf("MsgMax+%d", t-network.MsgMax)
+	}
+	return fmt.Sprintf("unknown type %d", t)
+}
+
+func flagNames(flags uint8) string {
+	var names []string
+	for _, f := range network.PacketFlags {
+		if flags&f.Value != 0 {
+			names = append(names, f.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(names, ", ") + ")"
+}
+
+func peerName(id string) string {
+	if id == "" {
+		return "?"
+	}
+	return id
+}
+
+func addr(a net.Addr) string {
+	if a == nil {
+		return "?"
+	}
+	return a.String()
+}
+
+// Formats a 64 bit timestamp in microseconds.
+func timestamp(b []uint8) string {
+	var us int64
+	for _, v := range b[:8] {
+		us = us<<8 | int64(v)
+	}
+	return time.UnixMicro(us).UTC().Format(time.RFC3339Nano)
+}
+
+// Formats a 16 bit loss fraction.
+func loss(b []uint8) string {
+	v := float64(uint16(b[0])<<8|uint16(b[1])) / 65535
+	return fmt.Sprintf("%.2f%%", v*100)
+}
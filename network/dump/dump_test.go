@@ -0,0 +1,157 @@
+package dump
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snuk182/gnarly/network"
+)
+
+// Captures a session between a server and a client on a memory network.
+func capture(t *testing.T, w network.CaptureWriter) {
+	clock := network.NewManualClock(time.Unix(1e9, 0))
+	n := network.NewMemoryNetwork()
+
+	eh := func(error) bool { return false }
+	mh := func(*network.Peer, uint8, interface{}) {}
+
+	var peers []*network.Peer
+	for i, addr := range []string{"10.0.0.1:7000", "10.0.0.2:5000"} {
+		tr, err := n.Listen(addr)
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+
+		p, _ := network.NewPeer(tr.LocalAddr(), []uint8{0, uint8(i + 1)})
+		cfg := &network.Config{Transport: tr, Clock: clock, PingInterval: time.Second}
+		if i == 0 {
+			cfg.Capture = w
+		}
+
+		if err = p.ListenConfig(cfg, mh, eh); err != nil {
+			t.Fatalf("ListenConfig: %v", err)
+		}
+		defer p.Close()
+		peers = append(peers, p)
+	}
+
+	peers[1].SendTo(peers[0].Addr, []uint8("hello"))
+	peers[1].SendTo(peers[0].Addr, bytes.Repeat([]uint8{'x'}, network.PacketSize+100))
+	n.Flush()
+
+	clock.Advance(time.Second)
+	n.Flush()
+}
+
+func TestDump(t *testing.T) {
+	var log, out bytes.Buffer
+	capture(t, network.NewCaptureLogWriter(&log))
+
+	r, err := Open(&log, "auto")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	d := New(&out)
+	if code := run(d, r, &out); code != 0 {
+		t.Fatalf("Exit code %d: %s", code, out.String())
+	}
+
+	s := out.String()
+	for _, want := range []string{
+		"in 10.0.0.2:5000 > 10.0.0.1:7000",
+		"out 10.0.0.1:7000 > 10.0.0.2:5000",
+		"MsgData, 5 bytes\n    \"hello\"",
+		"fragment 1 of 2",
+		"reassembled 2 fragments",
+		"MsgData, 1500 bytes",
+		"... 1244 more bytes",
+		"MsgPing, 10 bytes: sent 2001-09-09T01:46:41Z, loss 0.00%",
+		"MsgPong, 26 bytes",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Output does not contain %q:\n%s", want, s)
+		}
+	}
+
+	// The peer id of inbound packets is remembered for replies.
+	addr, _ := net.ResolveUDPAddr("udp", "10.0.0.2:5000")
+	client, _ := network.NewPeer(addr, []uint8{0, 2})
+	if c := strings.Count(s, "peer "+client.Id); c < 4 {
+		t.Errorf("Expected the client id on packets in both directions, found it %d times", c)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	dir := t.TempDir()
+
+	var pcap bytes.Buffer
+	pw, _ := network.NewPcapWriter(&pcap)
+	capture(t, pw)
+
+	files := map[string]string{
+		"hex.txt": "# A data message, one of another protocol version, a corrupt and a truncated packet\n" +
+			"0002 00 0001 00 68656c6c6f 01 cca03ff5\n0002 00 0002 00 6869 02 9409e28c\n" +
+			"0002 00 0003 00 6869 01 00000000\n0002\n",
+		"test.pcapng":  pcap.String(),
+		"invalid.text": "zz\n",
+	}
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []uint8(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out, errs bytes.Buffer
+	if code := Main([]string{"-x", filepath.Join(dir, "hex.txt"), filepath.Join(dir, "test.pcapng")}, &out, &errs); code != 0 {
+		t.Fatalf("Exit code %d: %s", code, errs.String())
+	}
+
+	s := out.String()
+	for _, want := range []string{
+		"- in ? > ?, 16 bytes\n  [000/001] | 0x00 | 0x0001 | 00 02 | peer ?\n  MsgData, 5 bytes\n    00000000  68 65 6c 6c 6f",
+		"- in ? > ?, 13 bytes\n  protocol version 2, expected 1",
+		"- in ? > ?, 13 bytes\n  invalid: checksum mismatch",
+		"- in ? > ?, 2 bytes\n  invalid: packet too short",
+		"reassembled 2 fragments",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Output does not contain %q:\n%s", want, s)
+		}
+	}
+
+	if code := Main([]string{filepath.Join(dir, "invalid.text")}, &out, &errs); code != 1 {
+		t.Errorf("Expected exit code 1 for invalid hex, got %d", code)
+	}
+
+	if code := Main([]string{"-key", "00"}, &out, &errs); code != 2 {
+		t.Errorf("Expected exit code 2 for keys the encrypter can not take, got %d", code)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	var keys keyList
+	for _, s := range []string{"0102", "5JHbNPKdaI5DuRuLuaTzyw===ff"} {
+		if err := keys.Set(s); err != nil {
+			t.Fatalf("Set(%q): %v", s, err)
+		}
+	}
+
+	if keys[0].peer != "" || !bytes.Equal(keys[0].key, []uint8{1, 2}) {
+		t.Errorf("Unexpected key %+v", keys[0])
+	}
+
+	if keys[1].peer != "5JHbNPKdaI5DuRuLuaTzyw==" || !bytes.Equal(keys[1].key, []uint8{0xff}) {
+		t.Errorf("Unexpected key %+v", keys[1])
+	}
+
+	if err := keys.Set("peer=xyz"); err == nil {
+		t.Errorf("Expected an error for an invalid key")
+	}
+}
@@ -0,0 +1,280 @@
+package dump
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/snuk182/gnarly/network"
+)
+
+// An Encrypter which needs key material to decrypt the payloads of a peer
+// can implement this interface. Main hands it the keys given with -key. An
+// empty peer id means the key applies to every peer.
+type KeySetter interface {
+	SetKey(peerid string, key []uint8)
+}
+
+// Runs the gnarly-dump command with the given arguments (without the program
+// name), and returns its exit code. Payloads are decoded with
+// network.Encryption and network.Compression, so a program with its own
+// codecs can set those and call Main to get a dump command which understands
+// its traffic.
+func Main(args []string, stdout, stderr io.Writer) int {
+	var keys keyList
+
+	fs := flag.NewFlagSet("gnarly-dump", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	format := fs.String("f", "auto", "Input format: auto, pcap, log or hex.")
+	listen := fs.String("listen", "", "Decode the datagrams received on this UDP `address`, instead of reading files.")
+	hexdump := fs.Bool("x", false, "Show payloads as a hex dump.")
+	max := fs.Int("max", 256, "Maximum number of payload `bytes` shown. 0 shows all.")
+	fs.Var(&keys, "key", "Decryption key as [peerid=]hex. Repeat for several peers.")
+
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, `Usage: gnarly-dump [options] [file ...]
+
+Decodes gnarly datagrams. Files can be pcap or pcapng captures, capture logs
+(see network.CaptureLogWriter), or text with one hex encoded datagram per line.
+Without files, standard input is read.
+
+`)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	out := bufio.NewWriter(stdout)
+	defer out.Flush()
+
+	// A live dump shows every datagram as soon as it arrives.
+	d := New(out)
+	if *listen != "" {
+		d = New(stdout)
+	}
+
+	d.Hex = *hexdump
+	d.MaxData = *max
+
+	if len(keys) > 0 {
+		ks, ok := d.Encryption.(KeySetter)
+		if !ok {
+			fmt.Fprintf(stderr, "[e] The encrypter does not take keys.\n")
+			return 2
+		}
+
+		for _, k := range keys {
+			ks.SetKey(k.peer, k.key)
+		}
+	}
+
+	if *listen != "" {
+		conn, err := net.ListenPacket("udp", *listen)
+		if err != nil {
+			fmt.Fprintf(stderr, "[e] %v\n", err)
+			return 1
+		}
+		defer conn.Close()
+		return run(d, &liveReader{conn}, stderr)
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	for _, name := range files {
+		var r io.Reader = os.Stdin
+		if name != "-" {
+			f, err := os.Open(name)
+			if err != nil {
+				fmt.Fprintf(stderr, "[e] %v\n", err)
+				return 1
+			}
+			defer f.Close()
+			r = f
+		}
+
+		cr, err := Open(r, *format)
+		if err != nil {
+			fmt.Fprintf(stderr, "[e] %s: %v\n", name, err)
+			return 1
+		}
+
+		if code := run(d, cr, stderr); code != 0 {
+			return code
+		}
+	}
+	return 0
+}
+
+func run(d *Dumper, r network.CaptureReader, stderr io.Writer) int {
+	defer d.Flush()
+
+	for {
+		c, err := r.ReadCapture()
+		if err == io.EOF {
+			return 0
+		}
+
+		if err != nil {
+			fmt.Fprintf(stderr, "[e] %v\n", err)
+			return 1
+		}
+
+		d.Dump(c)
+	}
+}
+
+// Returns a reader for captures in the given format: "pcap" (pcap or
+// pcapng), "log" (see network.CaptureLogWriter), "hex" (one datagram per
+// line) or "auto". Auto detects pcap files by their magic number, and
+// accepts both log and hex lines otherwise.
+func Open(r io.Reader, format string) (network.CaptureReader, error) {
+	br := bufio.NewReader(r)
+
+	if format == "auto" {
+		format = "text"
+		if magic, _ := br.Peek(4); len(magic) == 4 && isPcap(magic) {
+			format = "pcap"
+		}
+	}
+
+	switch format {
+	case "pcap":
+		return network.NewPcapReader(br), nil
+	case "log":
+		return network.NewCaptureLogReader(br), nil
+	case "hex", "text":
+		return &textReader{r: br, log: format == "text"}, nil
+	}
+	return nil, fmt.Errorf("Unknown input format %q", format)
+}
+
+// Checks for the magic number of a pcapng file, or of a classic pcap file in
+// either byte order and timestamp resolution.
+func isPcap(b []uint8) bool {
+	switch string(b) {
+	case "\x0a\x0d\x0d\x0a",
+		"\xd4\xc3\xb2\xa1", "\xa1\xb2\xc3\xd4",
+		"\x4d\x3c\xb2\xa1", "\xa1\xb2\x3c\x4d":
+		return true
+	}
+	return false
+}
+
+// Reads one datagram per line, hex encoded. Whitespace between bytes is
+// ignored, as is anything after a '#'. If log is set, lines in the capture
+// log format are accepted as well.
+type textReader struct {
+	r    *bufio.Reader
+	log  bool
+	line int
+}
+
+func (this *textReader) ReadCapture() (*network.Capture, error) {
+	for {
+		line, err := this.r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return nil, err
+		}
+
+		this.line++
+
+		if this.log && isLogLine(line) {
+			c, err := network.NewCaptureLogReader(strings.NewReader(line)).ReadCapture()
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %v", this.line, err)
+			}
+			return c, nil
+		}
+
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		line = strings.Join(strings.Fields(line), "")
+		if line == "" {
+			continue
+		}
+
+		c := &network.Capture{Inbound: true}
+		if c.Data, err = hex.DecodeString(line); err != nil {
+			return nil, fmt.Errorf("Invalid hex on line %d: %v", this.line, err)
+		}
+		return c, nil
+	}
+}
+
+// Checks if a line starts with the timestamp of a capture log line.
+func isLogLine(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+
+	_, err := time.Parse(time.RFC3339Nano, fields[0])
+	return err == nil
+}
+
+// Turns the datagrams received on a socket into captures.
+type liveReader struct {
+	conn net.PacketConn
+}
+
+func (this *liveReader) ReadCapture() (*network.Capture, error) {
+	b := make([]uint8, 65536)
+	n, addr, err := this.conn.ReadFrom(b)
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			err = io.EOF
+		}
+		return nil, err
+	}
+
+	return &network.Capture{
+		Time:    time.Now(),
+		Inbound: true,
+		Local:   this.conn.LocalAddr(),
+		Remote:  addr,
+		Data:    b[:n],
+	}, nil
+}
+
+// Values of the -key flag.
+type keyList []key
+
+type key struct {
+	peer string
+	key  []uint8
+}
+
+func (this *keyList) String() string {
+	return fmt.Sprintf("%d keys", len(*this))
+}
+
+func (this *keyList) Set(s string) (err error) {
+	// Peer ids may end in base64 padding, keys never contain a '='.
+	var k key
+	if i := strings.LastIndexByte(s, '='); i >= 0 {
+		k.peer, s = s[:i], s[i+1:]
+	}
+
+	if k.key, err = hex.DecodeString(s); err != nil {
+		return fmt.Errorf("Invalid key: %v", err)
+	}
+
+	*this = append(*this, k)
+	return
+}
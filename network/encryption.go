@@ -10,6 +10,26 @@ type Encrypter interface {
 	Decrypt(peerid string, data []uint8) []uint8
 }
 
+// An Encrypter which can write its output into a supplied buffer, can
+// implement this interface. The library then hands it pooled buffers, which
+// saves an allocation for every message. Both functions append their output
+// to dst and return the resulting slice, just like the append builtin.
+type AppendEncrypter interface {
+	Encrypter
+	AppendEncrypt(dst []uint8, peerid string, data []uint8) []uint8
+	AppendDecrypt(dst []uint8, peerid string, data []uint8) []uint8
+}
+
+// An Encrypter which uses the same key for every peer can implement this
+// interface. It allows broadcasts (see Peer.SendGroup) to encrypt the data
+// once, instead of once for every recipient.
+type SharedEncrypter interface {
+	Encrypter
+
+	// Returns true if the output of Encrypt is valid for any peer.
+	SharedKey() bool
+}
+
 // A simple implementation of the network.Encrypter interface.
 type GnarlyEncryption struct{}
 
@@ -24,3 +44,7 @@ func (this GnarlyEncryption) Encrypt(peerid string, in []uint8) []uint8 {
 func (this GnarlyEncryption) Decrypt(peerid string, in []uint8) []uint8 {
 	return in
 }
+
+func (this GnarlyEncryption) SharedKey() bool {
+	return true
+}
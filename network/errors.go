@@ -1,6 +1,10 @@
 package network
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"net"
+)
 
 var (
 	ErrInvalidClientID       = errors.New("Invalid Clientid specified")
@@ -9,4 +13,41 @@ var (
 	ErrInvalidErrorHandler   = errors.New("Invalid error handler")
 	ErrPacketSequenceTooLong = errors.New("Packet Sequence too long (>65535)")
 	ErrNoData                = errors.New("No data in packet.")
+	ErrAddressInUse          = errors.New("Address already in use")
+	ErrTimeout               = errors.New("Connection timed out")
+	ErrConnectionClosed      = errors.New("Connection closed")
+	ErrPayloadTooLarge       = errors.New("Payload too large (>255 fragments)")
+	ErrInvalidCapture        = errors.New("Invalid capture file")
+	ErrVersionMismatch       = errors.New("Protocol version mismatch")
+	ErrSendRate              = errors.New("Send rate exceeded")
+	ErrReceiveRate           = errors.New("Receive rate exceeded")
 )
+
+// Describes a problem with a packet we received. It wraps one of the errors
+// above, so errors.Is(err, ErrInvalidPacket) works as before, while
+// errors.As gives access to the address the packet came from. That is the
+// address to ban, when someone floods us with garbage.
+type PacketError struct {
+	Err      error    // The underlying error. Eg: ErrInvalidPacket.
+	Addr     net.Addr // Address the packet came from.
+	PeerId   string   // Id of the sending peer. Empty if the packet could not be attributed to one.
+	Sequence Seq      // Sequence number of the packet. Only valid if Header holds at least 5 bytes.
+	Header   []uint8  // Copy of the raw packet header, as far as it was received.
+}
+
+func (this *PacketError) Error() string {
+	s := fmt.Sprintf("%v (from %v", this.Err, this.Addr)
+
+	if this.PeerId != "" {
+		s += ", peer " + this.PeerId
+	}
+
+	if len(this.Header) >= 5 {
+		s += fmt.Sprintf(", seq %d", this.Sequence)
+	}
+	return s + ")"
+}
+
+func (this *PacketError) Unwrap() error {
+	return this.Err
+}
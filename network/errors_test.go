@@ -0,0 +1,164 @@
+package network
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacketError(t *testing.T) {
+	n := NewMemoryNetwork()
+
+	var lock sync.Mutex
+	var reported []error
+
+	eh := func(err error) bool {
+		lock.Lock()
+		reported = append(reported, err)
+		lock.Unlock()
+		return false
+	}
+
+	server, _ := newMemoryPeer(t, n, SystemClock, "10.0.0.1:7000", 1, nil, &peerConfig{ErrorHandler: eh})
+	defer server.Close()
+
+	from, err := n.Listen("10.0.0.2:7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer from.Close()
+
+	// Too short for a header, and a fragment without its subsequence bytes.
+	from.WriteTo([]uint8{0, 2, 0}, server.Addr)
+	from.WriteTo(sealed(0, 2, PFFragmented, 0, 42, 0), server.Addr)
+
+	// A valid packet with a broken checksum.
+	garbage := sealed(0, 2, 0, 0, 43, MsgData)
+	garbage[len(garbage)-1]++
+	from.WriteTo(garbage, server.Addr)
+	n.Flush()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(reported) != 3 {
+		t.Fatalf("Expected 3 errors, got %v", reported)
+	}
+
+	for _, err := range reported {
+		if !errors.Is(err, ErrInvalidPacket) {
+			t.Fatalf("Expected ErrInvalidPacket, got %v", err)
+		}
+	}
+
+	var pe *PacketError
+	if !errors.As(reported[0], &pe) || pe.Addr.String() != "10.0.0.2:7000" || len(pe.Header) != 3 || pe.PeerId != "" {
+		t.Fatalf("Unexpected error details: %#v", pe)
+	}
+
+	p, _ := NewPeer(from.LocalAddr(), []uint8{0, 2})
+	if !errors.As(reported[1], &pe) || pe.PeerId != p.Id || pe.Sequence != 42 || len(pe.Header) != 6 {
+		t.Fatalf("Unexpected error details: %#v", pe)
+	}
+
+	want := "Invalid packet format (from 10.0.0.2:7000, peer " + p.Id + ", seq 42)"
+	if s := pe.Error(); s != want {
+		t.Fatalf("Expected %q, got %q", want, s)
+	}
+
+	// Garbage is discarded before it is attributed to a peer.
+	if !errors.As(reported[2], &pe) || pe.PeerId != "" || pe.Sequence != 43 {
+		t.Fatalf("Unexpected error details: %#v", pe)
+	}
+}
+
+// Returns a datagram with the given header and data, and a trailer.
+func sealed(b ...uint8) []uint8 {
+	b = append(b, make([]uint8, TrailerSize)...)
+	Seal(b)
+	return b
+}
+
+func TestRejectRate(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	var lock sync.Mutex
+	var reported int
+
+	eh := func(err error) bool {
+		if errors.Is(err, ErrVersionMismatch) {
+			lock.Lock()
+			reported++
+			lock.Unlock()
+		}
+		return false
+	}
+
+	server, _ := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, &peerConfig{ErrorHandler: eh})
+	defer server.Close()
+
+	// Two senders of the next protocol version. Count the rejections they
+	// get back.
+	var senders []Transport
+	rejects := make([]int, 2)
+	for i, addr := range []string{"10.0.0.2:7000", "10.0.0.3:7000"} {
+		from, err := n.Listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer from.Close()
+		senders = append(senders, from)
+
+		go func(i int) {
+			b := make([]uint8, PacketSize)
+			for {
+				size, _, err := from.ReadFrom(b)
+				if err != nil {
+					return
+				}
+
+				if Packet(append(make([]uint8, 16), b[:size]...)).Flags()&PFReject != 0 {
+					lock.Lock()
+					rejects[i]++
+					lock.Unlock()
+				}
+			}
+		}(i)
+	}
+
+	burst := func(count int) (got []int, errs int) {
+		for _, from := range senders {
+			for i := 0; i < count; i++ {
+				from.WriteTo(sealVersion(sealed(0, 2, 0, 0, uint8(i), MsgData), ProtocolVersion+1), server.Addr)
+			}
+		}
+		n.Flush()
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		got = append(got, rejects...)
+		errs = reported
+		clear(rejects)
+		reported = 0
+		return
+	}
+
+	// Every datagram is dropped, but each address is answered once per ping
+	// interval.
+	if got, errs := burst(5); got[0] != 1 || got[1] != 1 || errs != 10 {
+		t.Fatalf("Expected 1 rejection per address and 10 errors, got %v and %d", got, errs)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if got, _ := burst(5); got[0] != 0 || got[1] != 0 {
+		t.Fatalf("Expected no rejections within the ping interval, got %v", got)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if got, _ := burst(5); got[0] != 1 || got[1] != 1 {
+		t.Fatalf("Expected 1 rejection per address after the ping interval, got %v", got)
+	}
+}
@@ -0,0 +1,132 @@
+package network
+
+// Adds the known peer with the given id to the named group. Groups are
+// created on demand and disappear again once their last member leaves. A peer
+// can be a member of any number of groups. Peers that disconnect or are
+// removed through RemoveClient are automatically taken out of all groups.
+func (this *Peer) JoinGroup(group, id string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	p, ok := this.clients[id]
+	if !ok {
+		return
+	}
+
+	if this.groups[group] == nil {
+		this.groups[group] = make(map[string]*Peer)
+	}
+
+	this.groups[group][id] = p
+}
+
+// Removes the peer with the given id from the named group.
+func (this *Peer) LeaveGroup(group, id string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if members, ok := this.groups[group]; ok {
+		delete(members, id)
+		if len(members) == 0 {
+			delete(this.groups, group)
+		}
+	}
+}
+
+// Returns the members of the named group.
+func (this *Peer) GroupMembers(group string) []*Peer {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	list := make([]*Peer, 0, len(this.groups[group]))
+	for _, p := range this.groups[group] {
+		list = append(list, p)
+	}
+	return list
+}
+
+// Sends the given data to every known peer, except those whose id is listed
+// in exclude. Use this to relay a message to everyone but its originator.
+func (this *Peer) BroadcastAll(data []uint8, exclude ...string) error {
+	this.lock.Lock()
+	list := collect(this.clients, exclude)
+	this.lock.Unlock()
+
+	return this.broadcast(list, data, MsgData)
+}
+
+// Sends the given data to every member of the named group, except those whose
+// id is listed in exclude.
+func (this *Peer) SendGroup(group string, data []uint8, exclude ...string) error {
+	this.lock.Lock()
+	list := collect(this.groups[group], exclude)
+	this.lock.Unlock()
+
+	return this.broadcast(list, data, MsgData)
+}
+
+// Sends one message to a list of peers. The data is compressed only once. If
+// the current Encrypter uses the same key for all peers (see SharedEncrypter),
+// it is encrypted only once as well. Otherwise it is encrypted separately for
+// each recipient. Each recipient still receives its own outbound sequence.
+//
+// Delivery is attempted for every peer, even if some of them fail. The first
+// error encountered is returned.
+func (this *Peer) broadcast(list []*Peer, data []uint8, msgtype uint8) (err error) {
+	if len(list) == 0 {
+		return
+	}
+
+	payload, flags, cbuf := compress(data, msgtype)
+	defer cbuf.release()
+
+	var shared []uint8
+	var sflags uint8
+	if se, ok := Encryption.(SharedEncrypter); ok && se.SharedKey() {
+		var sbuf *buffer
+		shared, sflags, sbuf = encrypt(list[0].Id, payload, flags)
+		defer sbuf.release()
+	}
+
+	now := this.clock.Now().UnixNano()
+
+	for _, p := range list {
+		var e error
+		limit := p.pmtu.get()
+
+		if shared != nil {
+			e = this.admit(p, now, shared, msgtype, limit)
+			if e == nil {
+				e = this.transmit(p, p.address(), shared, msgtype, sflags, limit)
+			}
+		} else {
+			out, f, ebuf := encrypt(p.Id, payload, flags)
+			e = this.admit(p, now, out, msgtype, limit)
+			if e == nil {
+				e = this.transmit(p, p.address(), out, msgtype, f, limit)
+			}
+			ebuf.release()
+		}
+
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Returns the peers in set, minus the ones listed in exclude.
+func collect(set map[string]*Peer, exclude []string) []*Peer {
+	list := make([]*Peer, 0, len(set))
+
+loop:
+	for id, p := range set {
+		for _, x := range exclude {
+			if id == x {
+				continue loop
+			}
+		}
+		list = append(list, p)
+	}
+	return list
+}
@@ -0,0 +1,153 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns the ids of the members of a group.
+func members(p *Peer, group string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, m := range p.GroupMembers(group) {
+		ids[m.Id] = true
+	}
+	return ids
+}
+
+func TestGroups(t *testing.T) {
+	loopback := func() *net.UDPAddr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+	// Polling stops on the first error. The only ones we expect come from
+	// closing the sockets.
+	eh := func(error) bool { return true }
+
+	server, _ := NewPeer(loopback(), []uint8{0, 1})
+	if err := server.Listen(uint64(50*time.Millisecond), 1, func(*Peer, uint8, interface{}) {}, eh); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer server.Close()
+
+	var lock sync.Mutex
+	counts := make([]int, 3)
+
+	var peers []*Peer
+	for i := range counts {
+		i := i
+		mh := func(_ *Peer, msgtype uint8, _ interface{}) {
+			if msgtype == MsgData {
+				lock.Lock()
+				counts[i]++
+				lock.Unlock()
+			}
+		}
+
+		p, _ := NewPeer(loopback(), []uint8{0, uint8(i + 2)})
+		if err := p.Listen(uint64(time.Minute), 60, mh, eh); err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+
+		p.SendTo(server.LocalAddr().(*net.UDPAddr), []uint8("hello"))
+		peers = append(peers, p)
+	}
+	defer peers[0].Close()
+	defer peers[1].Close()
+
+	a, b, c := peers[0].Id, peers[1].Id, peers[2].Id
+	eventually(t, "the clients to connect", func() bool {
+		return server.HasClient(a) && server.HasClient(b) && server.HasClient(c)
+	})
+
+	// Waits until the messages received by each client add up to want.
+	received := func(want []int) {
+		eventually(t, "the group messages", func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return counts[0] >= want[0] && counts[1] >= want[1] && counts[2] >= want[2]
+		})
+
+		lock.Lock()
+		defer lock.Unlock()
+		for i := range want {
+			if counts[i] != want[i] {
+				t.Fatalf("Expected %v messages, got %v", want, counts)
+			}
+		}
+	}
+
+	server.JoinGroup("red", a)
+	server.JoinGroup("red", b)
+	server.JoinGroup("red", "unknown")
+	server.JoinGroup("blue", c)
+
+	if m := members(server, "red"); len(m) != 2 || !m[a] || !m[b] {
+		t.Fatalf("Expected a and b in red, got %v", m)
+	}
+
+	if err := server.SendGroup("red", []uint8("red")); err != nil {
+		t.Fatalf("SendGroup: %v", err)
+	}
+	received([]int{1, 1, 0})
+
+	// The exclude argument leaves a out. Had it not, the count of a would be
+	// off by one after the next message to blue as well.
+	if err := server.SendGroup("red", []uint8("not a"), a); err != nil {
+		t.Fatalf("SendGroup: %v", err)
+	}
+	received([]int{1, 2, 0})
+
+	if err := server.SendGroup("green", []uint8("nobody")); err != nil {
+		t.Fatalf("SendGroup to an empty group: %v", err)
+	}
+
+	// A peer can be in several groups. Leaving one keeps the others.
+	server.JoinGroup("blue", a)
+	server.LeaveGroup("red", a)
+
+	if m := members(server, "red"); len(m) != 1 || !m[b] {
+		t.Fatalf("Expected only b in red, got %v", m)
+	}
+
+	if m := members(server, "blue"); len(m) != 2 || !m[a] || !m[c] {
+		t.Fatalf("Expected a and c in blue, got %v", m)
+	}
+
+	if err := server.SendGroup("blue", []uint8("blue")); err != nil {
+		t.Fatalf("SendGroup: %v", err)
+	}
+	received([]int{2, 2, 1})
+
+	// Groups disappear with their last member.
+	server.LeaveGroup("red", b)
+
+	server.lock.Lock()
+	_, ok := server.groups["red"]
+	server.lock.Unlock()
+
+	if ok {
+		t.Fatalf("Expected the empty group to be removed")
+	}
+
+	// Removed peers leave all their groups.
+	server.JoinGroup("red", a)
+	server.RemoveClient(a)
+
+	if m := members(server, "red"); len(m) != 0 {
+		t.Fatalf("Expected a removed peer to leave red, got %v", m)
+	}
+
+	if m := members(server, "blue"); len(m) != 1 || !m[c] {
+		t.Fatalf("Expected a removed peer to leave blue, got %v", m)
+	}
+
+	// So do peers which time out. c stops answering the pings.
+	peers[2].Close()
+	eventually(t, "c to time out", func() bool {
+		return !server.HasClient(c)
+	})
+
+	if m := members(server, "blue"); len(m) != 0 {
+		t.Fatalf("Expected a peer which timed out to leave blue, got %v", m)
+	}
+}
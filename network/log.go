@@ -0,0 +1,42 @@
+package network
+
+import (
+	"context"
+	"log/slog"
+	"net"
+)
+
+// Logs a record about a peer, if a logger is set. See SetLogger.
+func (this *Peer) logPeer(level slog.Level, msg string, client *Peer, attrs ...slog.Attr) {
+	if this.log == nil || !this.log.Enabled(context.Background(), level) {
+		return
+	}
+
+	attrs = append(attrs, slog.String("peer", client.Id), slog.String("addr", client.address().String()))
+	this.log.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// Logs a record about a packet, if a logger is set. The client is nil if the
+// packet could not be attributed to a peer. The header fields are only
+// included if the packet is long enough to hold them.
+func (this *Peer) logPacket(level slog.Level, msg string, client *Peer, addr net.Addr, packet Packet, reason string) {
+	if this.log == nil || !this.log.Enabled(context.Background(), level) {
+		return
+	}
+
+	attrs := make([]slog.Attr, 0, 6)
+	if client != nil {
+		attrs = append(attrs, slog.String("peer", client.Id))
+	}
+
+	if addr != nil {
+		attrs = append(attrs, slog.String("addr", addr.String()))
+	}
+
+	if len(packet) >= 21 {
+		attrs = append(attrs, slog.Int("seq", int(packet.Sequence())), slog.Int("flags", int(packet.Flags())))
+	}
+
+	attrs = append(attrs, slog.String("reason", reason))
+	this.log.LogAttrs(context.Background(), level, msg, attrs...)
+}
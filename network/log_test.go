@@ -0,0 +1,85 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A concurrency safe buffer for log output.
+type logBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (this *logBuffer) Write(p []byte) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.buf.Write(p)
+}
+
+// Returns the decoded records written so far.
+func (this *logBuffer) records(t *testing.T) (list []map[string]interface{}) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	dec := json.NewDecoder(bytes.NewReader(this.buf.Bytes()))
+	for dec.More() {
+		var r map[string]interface{}
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("Invalid log record: %v", err)
+		}
+		list = append(list, r)
+	}
+	return
+}
+
+func TestLogging(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	out := new(logBuffer)
+
+	cfg := &peerConfig{ErrorHandler: ignoreErrors}
+	cfg.Logger = slog.New(slog.NewJSONHandler(out, nil))
+	server, _ := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, cfg)
+	defer server.Close()
+
+	a, _ := newMemoryPeer(t, n, clock, "10.0.0.2:7000", 2, nil, nil)
+
+	a.SendTo(server.Addr, []byte("hello"))
+	n.Flush()
+
+	// A packet with a header, but without a message type.
+	packet := make(Packet, 16+5)
+	putAddrIP(packet, a.Addr)
+	packet[17] = 2
+	packet[20] = 42
+	server.process(a.Addr, packet, 0)
+
+	a.Close()
+	clock.Advance(6 * time.Second)
+	n.Flush()
+
+	records := out.records(t)
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 log records, got %v", records)
+	}
+
+	want := []map[string]interface{}{
+		{"msg": "Peer connected", "level": "INFO", "peer": a.Id, "addr": "10.0.0.2:7000"},
+		{"msg": "Dropped packet", "level": "WARN", "peer": a.Id, "addr": "10.0.0.2:7000", "seq": 42.0, "flags": 0.0, "reason": "packet too short"},
+		{"msg": "Peer disconnected", "level": "INFO", "peer": a.Id, "reason": "timeout"},
+	}
+
+	for i, w := range want {
+		for k, v := range w {
+			if records[i][k] != v {
+				t.Errorf("Record %d: expected %s=%v, got %v", i, k, v, records[i][k])
+			}
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package network
+
+import (
+	"net"
+	"sync"
+)
+
+// An in-process datagram network. Endpoints are created with Listen and
+// implement the Transport interface, so they can be handed to Peer.Serve.
+//
+// Datagrams written to an endpoint are not delivered right away. They wait in
+// a queue until Step or Flush is called. Combined with a ManualClock, this
+// allows a whole multi-peer session to be driven step by step from a unit
+// test, without binding real sockets or sleeping.
+type MemoryNetwork struct {
+	lock      sync.Mutex
+	cond      *sync.Cond
+	endpoints map[string]*MemoryTransport
+	pending   []transit
+	nextport  int
+}
+
+// A datagram in transit.
+type transit struct {
+	from net.Addr
+	to   string
+	data []byte
+}
+
+// Creates a new, empty memory network.
+func NewMemoryNetwork() *MemoryNetwork {
+	n := new(MemoryNetwork)
+	n.cond = sync.NewCond(&n.lock)
+	n.endpoints = make(map[string]*MemoryTransport)
+	n.nextport = 49152
+	return n
+}
+
+// Creates an endpoint on the given address. The address is a regular
+// ip:port string. Port 0 picks a free port.
+func (this *MemoryNetwork) Listen(address string) (t *MemoryTransport, err error) {
+	var addr *net.UDPAddr
+	if addr, err = net.ResolveUDPAddr("udp", address); err != nil {
+		return
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if addr.Port == 0 {
+		for {
+			addr.Port = this.nextport
+			this.nextport++
+			if _, ok := this.endpoints[addr.String()]; !ok {
+				break
+			}
+		}
+	}
+
+	if _, ok := this.endpoints[addr.String()]; ok {
+		return nil, ErrAddressInUse
+	}
+
+	t = &MemoryTransport{network: this, addr: addr}
+	this.endpoints[addr.String()] = t
+	return
+}
+
+// Delivers all datagrams currently in transit and waits until their receivers
+// have read them and are waiting for more. Datagrams sent in response are not
+// delivered; they are left for the next call. Datagrams for addresses nobody
+// listens on are dropped, just like UDP would. Returns the number of datagrams
+// which were in transit.
+func (this *MemoryNetwork) Step() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	batch := this.pending
+	this.pending = nil
+
+	for _, d := range batch {
+		if t, ok := this.endpoints[d.to]; ok {
+			t.inbox = append(t.inbox, d)
+		}
+	}
+
+	this.cond.Broadcast()
+
+	for !this.quiet() {
+		this.cond.Wait()
+	}
+
+	return len(batch)
+}
+
+// Calls Step until there is no more traffic in transit. Returns the total
+// number of datagrams delivered.
+func (this *MemoryNetwork) Flush() (n int) {
+	for {
+		c := this.Step()
+		if c == 0 {
+			return
+		}
+		n += c
+	}
+}
+
+// Reports whether every endpoint has consumed its inbox and finished handling
+// the last datagram it read. Called with this.lock held.
+func (this *MemoryNetwork) quiet() bool {
+	for _, t := range this.endpoints {
+		if len(t.inbox) > 0 || t.busy {
+			return false
+		}
+	}
+	return true
+}
+
+// A single endpoint on a MemoryNetwork. It implements the Transport interface.
+type MemoryTransport struct {
+	network *MemoryNetwork
+	addr    *net.UDPAddr
+	inbox   []transit
+	busy    bool // A datagram has been read, but the reader has not come back for the next one.
+	closed  bool
+}
+
+// Blocks until a datagram has been delivered to this endpoint by
+// MemoryNetwork.Step, or until the endpoint is closed. Calling ReadFrom again
+// signals that the previous datagram has been handled.
+func (this *MemoryTransport) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	nw := this.network
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+
+	this.busy = false
+	nw.cond.Broadcast()
+
+	for len(this.inbox) == 0 && !this.closed {
+		nw.cond.Wait()
+	}
+
+	if this.closed {
+		return 0, nil, net.ErrClosed
+	}
+
+	d := this.inbox[0]
+	this.inbox = this.inbox[1:]
+	this.busy = true
+
+	// Just like UDP, excess data is discarded.
+	n = copy(b, d.data)
+	return n, d.from, nil
+}
+
+// Queues a datagram for delivery to the given address.
+func (this *MemoryTransport) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	nw := this.network
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+
+	if this.closed {
+		return 0, net.ErrClosed
+	}
+
+	var to *net.UDPAddr
+	if to, err = net.ResolveUDPAddr("udp", addr.String()); err != nil {
+		return
+	}
+
+	nw.pending = append(nw.pending, transit{
+		from: this.addr,
+		to:   to.String(),
+		data: append([]byte(nil), b...),
+	})
+	return len(b), nil
+}
+
+// Closes the endpoint and frees its address. Blocked ReadFrom calls return
+// net.ErrClosed.
+func (this *MemoryTransport) Close() error {
+	nw := this.network
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+
+	if this.closed {
+		return net.ErrClosed
+	}
+
+	this.closed = true
+	this.inbox = nil
+	delete(nw.endpoints, this.addr.String())
+	nw.cond.Broadcast()
+	return nil
+}
+
+func (this *MemoryTransport) LocalAddr() net.Addr {
+	return this.addr
+}
@@ -0,0 +1,400 @@
+package network
+
+import "testing"
+import "time"
+import "sync"
+import "bytes"
+
+// Records everything a listener reports through its message handler.
+type recorder struct {
+	lock     sync.Mutex
+	messages []message
+}
+
+type message struct {
+	peer    string
+	msgtype uint8
+	data    interface{}
+}
+
+func (this *recorder) handle(p *Peer, msgtype uint8, data interface{}) {
+	if b, ok := data.([]uint8); ok {
+		data = Retain(b)
+	}
+
+	this.lock.Lock()
+	this.messages = append(this.messages, message{p.Id, msgtype, data})
+	this.lock.Unlock()
+}
+
+// Returns and clears the recorded messages of the given type.
+func (this *recorder) take(msgtype uint8) (list []message) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	rest := this.messages[:0]
+	for _, m := range this.messages {
+		if m.msgtype == msgtype {
+			list = append(list, m)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+	this.messages = rest
+	return
+}
+
+// Settings for newMemoryPeer. Any zero field takes on its default.
+type peerConfig struct {
+	Config                                 // Handed to ListenConfig. Pings go out every second, and peers time out after 5.
+	Wrap         func(Transport) Transport // Wraps the memory transport, in a SimulatedTransport for instance.
+	ErrorHandler ErrorHandler              // Defaults to failing the test.
+}
+
+// An ErrorHandler for tests which provoke errors on purpose.
+func ignoreErrors(error) bool { return false }
+
+// Creates a listening peer on the memory network. Messages are recorded,
+// unless a handler of our own is supplied. A nil cfg uses the defaults.
+func newMemoryPeer(t *testing.T, n *MemoryNetwork, c Clock, addr string, id uint8, mh MessageHandler, cfg *peerConfig) (*Peer, *recorder) {
+	tr, err := n.Listen(addr)
+	if err != nil {
+		t.Fatalf("Listen(%q): %v", addr, err)
+	}
+
+	p, err := NewPeer(tr.LocalAddr(), []uint8{0, id})
+	if err != nil {
+		t.Fatalf("NewPeer: %v", err)
+	}
+
+	if cfg == nil {
+		cfg = new(peerConfig)
+	}
+
+	settings := cfg.Config
+	if settings.PingInterval == 0 {
+		settings.PingInterval = time.Second
+	}
+
+	if settings.Timeout == 0 {
+		settings.Timeout = 5 * time.Second
+	}
+
+	settings.Clock = c
+	settings.Transport = tr
+	if cfg.Wrap != nil {
+		settings.Transport = cfg.Wrap(tr)
+	}
+
+	eh := cfg.ErrorHandler
+	if eh == nil {
+		eh = func(err error) bool {
+			t.Errorf("Unexpected error on %v: %v", addr, err)
+			return false
+		}
+	}
+
+	r := new(recorder)
+	if mh == nil {
+		mh = r.handle
+	}
+
+	p.SetClock(c)
+	if err = p.ListenConfig(&settings, mh, eh); err != nil {
+		t.Fatalf("ListenConfig: %v", err)
+	}
+	return p, r
+}
+
+func TestMemorySession(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	server, srec := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, nil)
+	a, arec := newMemoryPeer(t, n, clock, "10.0.0.2:0", 2, nil, nil)
+	b, brec := newMemoryPeer(t, n, clock, "10.0.0.3:0", 3, nil, nil)
+	defer server.Close()
+	defer a.Close()
+	defer b.Close()
+
+	// Both clients introduce themselves.
+	a.SendTo(server.Addr, []byte("hello from a"))
+	b.SendTo(server.Addr, []byte("hello from b"))
+
+	if c := n.Flush(); c != 2 {
+		t.Fatalf("Expected 2 datagrams, got %d", c)
+	}
+
+	if c := len(srec.take(MsgPeerConnected)); c != 2 {
+		t.Fatalf("Expected 2 connected peers, got %d", c)
+	}
+
+	if c := len(srec.take(MsgData)); c != 2 {
+		t.Fatalf("Expected 2 data messages, got %d", c)
+	}
+
+	// Relay a large message from a to everyone else.
+	big := bytes.Repeat([]byte("0123456789"), PacketSize)
+	if err := server.BroadcastAll(big, a.Id); err != nil {
+		t.Fatalf("BroadcastAll: %v", err)
+	}
+
+	n.Flush()
+
+	if msgs := brec.take(MsgData); len(msgs) != 1 || !bytes.Equal(msgs[0].data.([]byte), big) {
+		t.Fatalf("b did not receive the broadcast intact")
+	}
+
+	if msgs := arec.take(MsgData); len(msgs) != 0 {
+		t.Fatalf("a should have been excluded from the broadcast")
+	}
+
+	// A ping round measures latency; no time passes on the wire.
+	clock.Advance(time.Second)
+	n.Flush()
+
+	if msgs := srec.take(MsgLatency); len(msgs) != 2 {
+		t.Fatalf("Expected 2 latency reports, got %d", len(msgs))
+	}
+
+	// Silence the clients and let the server time them out.
+	a.Close()
+	b.Close()
+
+	clock.Advance(6 * time.Second)
+	n.Flush()
+
+	if c := len(srec.take(MsgPeerDisconnected)); c != 2 {
+		t.Fatalf("Expected 2 disconnected peers, got %d", c)
+	}
+
+	if server.HasClient(a.Id) || server.HasClient(b.Id) {
+		t.Fatalf("Timed out peers are still listed")
+	}
+}
+
+func TestPeerSend(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	server, _ := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, nil)
+	a, arec := newMemoryPeer(t, n, clock, "10.0.0.2:0", 2, nil, nil)
+	b, brec := newMemoryPeer(t, n, clock, "10.0.0.3:0", 3, nil, nil)
+	defer server.Close()
+	defer a.Close()
+	defer b.Close()
+
+	a.SendTo(server.Addr, []byte("hello"))
+	b.SendTo(server.Addr, []byte("hello"))
+	n.Flush()
+
+	pa, pb := server.GetClient(a.Id), server.GetClient(b.Id)
+	if pa == nil || pb == nil {
+		t.Fatalf("Server does not know both clients")
+	}
+
+	// Each remote peer numbers its own packets. SendTo the address of a known
+	// peer is the same as Send on it.
+	for i := 0; i < 3; i++ {
+		pa.Send([]byte("to a"))
+	}
+	server.SendTo(a.Addr, []byte("to a"))
+	pb.Send([]byte("to b"))
+	n.Flush()
+
+	sequence := func(p *Peer) Seq {
+		p.outlock.Lock()
+		defer p.outlock.Unlock()
+		return p.Sequence
+	}
+
+	if sa, sb, s := sequence(pa), sequence(pb), sequence(server); sa != 4 || sb != 1 || s != 0 {
+		t.Fatalf("Expected sequences of 4 to a, 1 to b and 0 of our own, got %d, %d and %d", sa, sb, s)
+	}
+
+	if c := len(arec.take(MsgData)); c != 4 {
+		t.Fatalf("Expected 4 messages to a, got %d", c)
+	}
+
+	if c := len(brec.take(MsgData)); c != 1 {
+		t.Fatalf("Expected 1 message to b, got %d", c)
+	}
+
+	// Neither client sees the packets of the other as a gap.
+	for _, p := range []*Peer{a, b} {
+		if st := p.GetClient(server.Id).Stats(); st.LossIn != 0 || st.OutOfOrder != 0 || st.Duplicates != 0 {
+			t.Fatalf("Expected no loss, reordering or duplicates on %v, got %+v", p.Addr, st)
+		}
+	}
+}
+
+func TestConcurrentSend(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	server, _ := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, nil)
+	a, arec := newMemoryPeer(t, n, clock, "10.0.0.2:0", 2, nil, nil)
+	defer server.Close()
+	defer a.Close()
+
+	a.SendTo(server.Addr, []byte("hello"))
+	n.Flush()
+
+	client := server.GetClient(a.Id)
+	if client == nil {
+		t.Fatalf("Server does not know a")
+	}
+
+	// Small and fragmented messages from several goroutines, while the
+	// server pings its clients.
+	small := []byte("small")
+	big := bytes.Repeat([]byte("0123456789"), PacketSize/2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := client.Send(small); err != nil {
+					t.Errorf("Send: %v", err)
+				}
+				if err := client.Send(big); err != nil {
+					t.Errorf("Send: %v", err)
+				}
+			}
+		}()
+	}
+
+	clock.Advance(time.Second)
+	wg.Wait()
+	n.Flush()
+
+	msgs := arec.take(MsgData)
+	if len(msgs) != 8*20*2 {
+		t.Fatalf("Expected %d messages, got %d", 8*20*2, len(msgs))
+	}
+
+	for _, m := range msgs {
+		data := m.data.([]byte)
+		if !bytes.Equal(data, small) && !bytes.Equal(data, big) {
+			t.Fatalf("Received a corrupted message of %d bytes", len(data))
+		}
+	}
+}
+
+func TestSendWhileReceiving(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	server, srec := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, nil)
+	a, arec := newMemoryPeer(t, n, clock, "10.0.0.2:0", 2, nil, nil)
+	defer server.Close()
+	defer a.Close()
+
+	a.SendTo(server.Addr, []byte("hello"))
+	n.Flush()
+
+	client := server.GetClient(a.Id)
+	if client == nil {
+		t.Fatalf("Server does not know a")
+	}
+
+	// The server updates the client's address with every packet it
+	// processes, while we send to it.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if err := client.Send([]byte("down")); err != nil {
+				t.Errorf("Send: %v", err)
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		a.SendTo(server.Addr, []byte("up"))
+		n.Flush()
+	}
+
+	<-done
+	n.Flush()
+
+	if got := len(srec.take(MsgData)); got != 1001 {
+		t.Fatalf("Expected 1001 messages on the server, got %d", got)
+	}
+
+	if got := len(arec.take(MsgData)); got != 1000 {
+		t.Fatalf("Expected 1000 messages on a, got %d", got)
+	}
+}
+
+func TestCloseFromHandler(t *testing.T) {
+	cases := []struct {
+		name    string
+		clock   Clock
+		workers int
+		msgtype uint8 // Close when this message arrives.
+		garbage bool  // Close when an error is reported, rather than a message.
+	}{
+		{"polling", NewManualClock(time.Unix(1e9, 0)), 0, MsgData, false},
+		{"worker", NewManualClock(time.Unix(1e9, 0)), 4, MsgData, false},
+		{"error", NewManualClock(time.Unix(1e9, 0)), 0, 0, true},
+		{"ping", SystemClock, 0, MsgPeerDisconnected, false}, // The clock pings on a goroutine of its own.
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := NewMemoryNetwork()
+
+			var server *Peer
+			closed := make(chan struct{})
+			shut := func() {
+				server.Close()
+				close(closed)
+			}
+
+			mh := func(p *Peer, msgtype uint8, data interface{}) {
+				if msgtype == c.msgtype && !c.garbage {
+					shut()
+				}
+			}
+
+			eh := func(err error) bool {
+				if c.garbage {
+					shut()
+				}
+				return false
+			}
+
+			cfg := &peerConfig{ErrorHandler: eh}
+			cfg.Workers = c.workers
+			cfg.PingInterval = 10 * time.Millisecond
+			cfg.Timeout = time.Second
+			server, _ = newMemoryPeer(t, n, c.clock, "10.0.0.1:7000", 1, mh, cfg)
+
+			from, err := n.Listen("10.0.0.2:7000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer from.Close()
+
+			if c.garbage {
+				from.WriteTo([]uint8{0, 2, 0}, server.Addr)
+			} else {
+				from.WriteTo(sealed(0, 2, 0, 0, 0, MsgData, 'x'), server.Addr)
+			}
+			n.Step()
+
+			select {
+			case <-closed:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("Close did not return")
+			}
+
+			if server.LocalAddr() != nil {
+				t.Fatalf("Expected the transport to be released")
+			}
+		})
+	}
+}
@@ -7,7 +7,11 @@ const (
 	MsgPong                          // Response to Ping message
 	MsgPeerConnected                 // A new peer has been detected
 	MsgPeerDisconnected              // A known peer has timed out.
-	MsgLatency                       // Reports a client's latency at customizable intervals
+	MsgLatency                       // Reports a client's smoothed round trip time (time.Duration) at customizable intervals
+	MsgConnect                       // Handshake request sent by Dial.
+	MsgAccept                        // Handshake response to MsgConnect.
+	MsgProbe                         // Padded path MTU probe. See Config.PathMTU.
+	MsgProbeAck                      // Response to MsgProbe.
 
 	// Dummy value. Used to indicate where a host application should start
 	// defining it's own message types. MsgMax, MsgMax+1, MsgMax+2 etc.
@@ -0,0 +1,180 @@
+// Package metrics exports the statistics of gnarly listeners in the
+// Prometheus text exposition format, without depending on the Prometheus
+// client library.
+//
+//	http.Handle("/metrics", metrics.New(listener))
+//
+// The totals of every listener are always exported. Per peer series can be
+// turned off with Handler.PerPeer, for servers with many peers.
+package metrics
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/snuk182/gnarly/network"
+)
+
+// An http.Handler which serves the statistics of one or more listeners.
+type Handler struct {
+	listeners []*network.Peer
+	PerPeer   bool // Export series for every known peer. Defaults to true.
+}
+
+// Creates a handler for the given listeners. Their series carry a
+// listener label with the local address of the listener.
+func New(listeners ...*network.Peer) *Handler {
+	h := new(Handler)
+	h.listeners = listeners
+	h.PerPeer = true
+	return h
+}
+
+// A metric family: the samples of one metric name.
+type family struct {
+	name    string
+	help    string
+	kind    string
+	samples []sample
+}
+
+type sample struct {
+	suffix string // Appended to the family name. Used for histograms.
+	labels []string
+	value  float64
+}
+
+func (this *family) add(value float64, labels ...string) {
+	this.samples = append(this.samples, sample{"", labels, value})
+}
+
+func (this *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	out := bufio.NewWriter(w)
+	for _, f := range this.collect() {
+		write(out, f)
+	}
+	out.Flush()
+}
+
+// Takes a snapshot of all statistics.
+func (this *Handler) collect() []*family {
+	peers := &family{name: "gnarly_peers", help: "Number of known peers.", kind: "gauge"}
+	psent := &family{name: "gnarly_packets_sent_total", help: "Packets sent.", kind: "counter"}
+	precv := &family{name: "gnarly_packets_received_total", help: "Packets received.", kind: "counter"}
+	bsent := &family{name: "gnarly_bytes_sent_total", help: "Bytes sent, including packet headers.", kind: "counter"}
+	brecv := &family{name: "gnarly_bytes_received_total", help: "Bytes received, including packet headers.", kind: "counter"}
+	dropped := &family{name: "gnarly_dropped_packets_total", help: "Invalid packets which were discarded.", kind: "counter"}
+	failed := &family{name: "gnarly_reassembly_failures_total", help: "Fragmented messages abandoned because fragments went missing or timed out.", kind: "counter"}
+	rtt := &family{name: "gnarly_rtt_seconds", help: "Round trip time samples of all peers.", kind: "histogram"}
+
+	list := []*family{peers, psent, precv, bsent, brecv, dropped, failed, rtt}
+
+	var prtt, pvar, pjitter, ploss, ppsent, pprecv, pbsent, pbrecv, poffset, pmtu, prate *family
+	if this.PerPeer {
+		prtt = &family{name: "gnarly_peer_rtt_seconds", help: "Smoothed round trip time of a peer.", kind: "gauge"}
+		pvar = &family{name: "gnarly_peer_rtt_variation_seconds", help: "Round trip time variation of a peer.", kind: "gauge"}
+		pjitter = &family{name: "gnarly_peer_jitter_seconds", help: "Round trip time jitter of a peer.", kind: "gauge"}
+		ploss = &family{name: "gnarly_peer_loss_ratio", help: "Fraction of recent packets lost, per direction.", kind: "gauge"}
+		poffset = &family{name: "gnarly_peer_clock_offset_seconds", help: "Estimated offset of the clock of a peer.", kind: "gauge"}
+		pmtu = &family{name: "gnarly_peer_path_mtu_bytes", help: "Largest datagram sent to a peer, without IP and UDP headers.", kind: "gauge"}
+		prate = &family{name: "gnarly_peer_send_rate_bytes", help: "Bytes per second we may send to a peer. 0 means unlimited.", kind: "gauge"}
+		ppsent = &family{name: "gnarly_peer_packets_sent_total", help: "Packets sent to a peer.", kind: "counter"}
+		pprecv = &family{name: "gnarly_peer_packets_received_total", help: "Packets received from a peer.", kind: "counter"}
+		pbsent = &family{name: "gnarly_peer_bytes_sent_total", help: "Bytes sent to a peer.", kind: "counter"}
+		pbrecv = &family{name: "gnarly_peer_bytes_received_total", help: "Bytes received from a peer.", kind: "counter"}
+		list = append(list, prtt, pvar, pjitter, ploss, poffset, pmtu, prate, ppsent, pprecv, pbsent, pbrecv)
+	}
+
+	for _, l := range this.listeners {
+		name := ""
+		if addr := l.LocalAddr(); addr != nil {
+			name = addr.String()
+		}
+
+		st := l.Stats()
+		clients := l.Clients()
+
+		peers.add(float64(len(clients)), "listener", name)
+		psent.add(float64(st.PacketsSent), "listener", name)
+		precv.add(float64(st.PacketsReceived), "listener", name)
+		bsent.add(float64(st.BytesSent), "listener", name)
+		brecv.add(float64(st.BytesReceived), "listener", name)
+		dropped.add(float64(st.Dropped), "listener", name)
+		failed.add(float64(st.ReassemblyFailures), "listener", name)
+
+		for i, b := range network.RTTBuckets {
+			rtt.samples = append(rtt.samples, sample{"_bucket",
+				[]string{"listener", name, "le", formatFloat(b.Seconds())}, float64(st.RTTHistogram[i])})
+		}
+
+		count := float64(st.RTTHistogram[len(network.RTTBuckets)])
+		rtt.samples = append(rtt.samples,
+			sample{"_bucket", []string{"listener", name, "le", "+Inf"}, count},
+			sample{"_sum", []string{"listener", name}, st.RTTSum.Seconds()},
+			sample{"_count", []string{"listener", name}, count})
+
+		if !this.PerPeer {
+			continue
+		}
+
+		sort.Slice(clients, func(i, j int) bool { return clients[i].Id < clients[j].Id })
+
+		for _, p := range clients {
+			ps := p.Stats()
+			labels := []string{"listener", name, "peer", p.Id}
+
+			prtt.add(ps.RTT.Seconds(), labels...)
+			pvar.add(ps.RTTVar.Seconds(), labels...)
+			pjitter.add(ps.Jitter.Seconds(), labels...)
+			ploss.add(ps.LossIn, append(labels, "direction", "in")...)
+			ploss.add(ps.LossOut, append(labels, "direction", "out")...)
+			poffset.add(p.ClockOffset().Seconds(), labels...)
+			pmtu.add(float64(ps.PathMTU), labels...)
+			prate.add(float64(ps.SendRate), labels...)
+			ppsent.add(float64(ps.PacketsSent), labels...)
+			pprecv.add(float64(ps.PacketsReceived), labels...)
+			pbsent.add(float64(ps.BytesSent), labels...)
+			pbrecv.add(float64(ps.BytesReceived), labels...)
+		}
+	}
+	return list
+}
+
+// Writes a metric family in the text exposition format.
+func write(w *bufio.Writer, f *family) {
+	w.WriteString("# HELP " + f.name + " " + f.help + "\n")
+	w.WriteString("# TYPE " + f.name + " " + f.kind + "\n")
+
+	for _, s := range f.samples {
+		w.WriteString(f.name + s.suffix)
+
+		if len(s.labels) > 0 {
+			w.WriteByte('{')
+			for i := 0; i < len(s.labels); i += 2 {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				w.WriteString(s.labels[i] + `="` + escape(s.labels[i+1]) + `"`)
+			}
+			w.WriteByte('}')
+		}
+
+		w.WriteString(" " + formatFloat(s.value) + "\n")
+	}
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Escapes a label value.
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
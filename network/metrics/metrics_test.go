@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snuk182/gnarly/network"
+)
+
+func TestHandler(t *testing.T) {
+	clock := network.NewManualClock(time.Unix(1e9, 0))
+	n := network.NewMemoryNetwork()
+
+	listen := func(addr string, id uint8) *network.Peer {
+		tr, err := n.Listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, _ := network.NewPeer(tr.LocalAddr(), []uint8{0, id})
+		p.SetClock(clock)
+
+		mh := func(*network.Peer, uint8, interface{}) {}
+		eh := func(error) bool { return false }
+		if err = p.Serve(tr, uint64(time.Second), 5, mh, eh); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	server := listen("10.0.0.1:7000", 1)
+	a := listen("10.0.0.2:7000", 2)
+	defer server.Close()
+	defer a.Close()
+
+	a.SendTo(server.Addr, []byte("hello"))
+	n.Flush()
+
+	// One ping round, so there is an RTT sample.
+	clock.Advance(time.Second)
+	n.Flush()
+
+	rec := httptest.NewRecorder()
+	New(server).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Unexpected content type %q", ct)
+	}
+
+	body, _ := io.ReadAll(rec.Body)
+	text := string(body)
+
+	for _, want := range []string{
+		"# TYPE gnarly_peers gauge\n",
+		`gnarly_peers{listener="10.0.0.1:7000"} 1` + "\n",
+		`gnarly_packets_received_total{listener="10.0.0.1:7000"} 2` + "\n",
+		`gnarly_packets_sent_total{listener="10.0.0.1:7000"} 1` + "\n",
+		"# TYPE gnarly_rtt_seconds histogram\n",
+		`gnarly_rtt_seconds_bucket{listener="10.0.0.1:7000",le="0.001"} 1` + "\n",
+		`gnarly_rtt_seconds_bucket{listener="10.0.0.1:7000",le="+Inf"} 1` + "\n",
+		`gnarly_rtt_seconds_count{listener="10.0.0.1:7000"} 1` + "\n",
+		`gnarly_peer_loss_ratio{listener="10.0.0.1:7000",peer="` + a.Id + `",direction="out"} 0` + "\n",
+		`gnarly_peer_path_mtu_bytes{listener="10.0.0.1:7000",peer="` + a.Id + `"} 1378` + "\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Missing %q in:\n%s", want, text)
+		}
+	}
+
+	// Without per peer series.
+	h := New(server)
+	h.PerPeer = false
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if strings.Contains(rec.Body.String(), "gnarly_peer_") {
+		t.Fatalf("Per peer series were exported")
+	}
+}
+
+func TestEscape(t *testing.T) {
+	if s := escape("a\\b\"c\nd"); s != `a\\b\"c\nd` {
+		t.Fatalf("Unexpected escaping: %s", s)
+	}
+}
@@ -1,7 +1,6 @@
 package network
 
 import "net"
-import "strings"
 
 // This is the size of a standard UDP datagram header. it is part of every
 // packet we send. This header is processed by the operating system's transport
@@ -27,6 +26,9 @@ const UdpHeaderSize = 22
 // modern applications, it does put dial-up users at a disadvantage. 576 bytes
 // ensures maximum compatibility, but If you are not targeting these, we
 // recommend changing this to 1400 byte.
+//
+// With Config.PathMTU, this is only where the search for the size of each
+// peer's path starts.
 var PacketSize int = 1400
 
 // When set, this will be used to (de)compress packet data if the appropriate
@@ -48,7 +50,6 @@ var Encryption Encrypter = NewGnarlyEncryption()
 
 // Creates a 2 byte ClientID from the local machine's IP.
 func GetClientId() (id []byte, err error) {
-	var conn *net.UDPConn
 	var addr *net.UDPAddr
 
 	// Connect to a random machine somewhere in this subnet. It's irrelevant
@@ -57,21 +58,23 @@ func GetClientId() (id []byte, err error) {
 		return
 	}
 
+	return clientIdFor(addr)
+}
+
+// Creates a 2 byte ClientID from the local IP the operating system would use
+// to reach the given address. No data is actually sent.
+func clientIdFor(addr *net.UDPAddr) (id []byte, err error) {
+	var conn *net.UDPConn
+
 	if conn, err = net.DialUDP("udp", nil, addr); err != nil {
 		return
 	}
 
 	defer conn.Close()
 
-	// strip port number off.
-	str := conn.LocalAddr().String()
-	if idx := strings.LastIndex(str, ":"); idx != -1 {
-		str = str[0:idx]
-	}
-
 	var ip net.IP
-	if ip = net.ParseIP(str).To16(); ip == nil {
-		return
+	if ip = conn.LocalAddr().(*net.UDPAddr).IP.To16(); ip == nil {
+		return nil, ErrInvalidClientID
 	}
 
 	// TODO(jimt): I am unsure how 2 full IPv6 addresses in the same subnet relate
@@ -5,6 +5,7 @@ import "net"
 import "crypto/md5"
 import "encoding/base64"
 import "bytes"
+import "time"
 
 func TestPeerIdIPv4(t *testing.T) {
 	a := getPeerId(t, "80.254.11.3", "192.168.2.101")
@@ -51,3 +52,94 @@ func getPeerId(t *testing.T, public, private string) string {
 	enc.Close()
 	return buf.String()
 }
+
+// Waits up to a few seconds for a condition which depends on real traffic.
+func eventually(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBindReceive(t *testing.T) {
+	eh := func(err error) bool {
+		t.Errorf("Unexpected error: %v", err)
+		return false
+	}
+
+	// Echo everything back to the sender.
+	srec := new(recorder)
+	echo := func(p *Peer, msgtype uint8, data interface{}) {
+		srec.handle(p, msgtype, data)
+		if msgtype == MsgData {
+			p.Send(data.([]byte))
+		}
+	}
+
+	server, _ := NewPeer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, []uint8{0, 1})
+	if err := server.Listen(uint64(50*time.Millisecond), 5, echo, eh); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer server.Close()
+
+	// The client never listens. Its first send binds a socket, which then
+	// gets the echo and the pings of the server.
+	client, _ := NewPeer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, []uint8{0, 2})
+	r := new(recorder)
+	client.SetHandlers(r.handle, eh)
+
+	if err := client.SendTo(server.LocalAddr(), []uint8("hello")); err != nil {
+		t.Fatalf("SendTo: %v", err)
+	}
+
+	var got []message
+	eventually(t, "the echo", func() bool {
+		got = append(got, r.take(MsgData)...)
+		return len(got) > 0
+	})
+
+	if string(got[0].data.([]uint8)) != "hello" {
+		t.Fatalf("Expected hello, got %q", got[0].data)
+	}
+
+	// The server measures the round trip from the pongs of the client.
+	eventually(t, "a pong", func() bool {
+		return len(srec.take(MsgLatency)) > 0
+	})
+
+	// Closing the client releases its socket.
+	addr := client.LocalAddr()
+	client.Close()
+
+	if err := client.SendTo(server.LocalAddr(), []uint8("hello")); err != net.ErrClosed {
+		t.Fatalf("Expected net.ErrClosed after Close, got %v", err)
+	}
+
+	conn, err := net.ListenUDP("udp", addr.(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Expected the socket of the client to be released: %v", err)
+	}
+	conn.Close()
+}
+
+func TestPacketOwner(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("80.254.11.3"), Port: 7000}
+	p, _ := NewPeer(addr, []uint8{1, 101})
+
+	// The address prefix of a received packet, followed by the client id.
+	packet := make(Packet, 18)
+	putAddrIP(packet, addr)
+	packet[16], packet[17] = 1, 101
+
+	owner := packet.Owner()
+	if len(owner) != 16 {
+		t.Fatalf("Expected a 16 byte md5 hash, got %d bytes", len(owner))
+	}
+
+	if id := base64.StdEncoding.EncodeToString([]byte(owner)); id != p.Id {
+		t.Fatalf("Expected the encoded owner %q to equal the peer id %q", id, p.Id)
+	}
+}
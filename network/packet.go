@@ -9,6 +9,7 @@ const (
 	PFCompressed uint8 = 1 << iota // Indicates the packet is compressed.
 	PFEncrypted                    // Tells us that the packet content is encrypted.
 	PFFragmented                   // This tells us the packet is 1 part of a larger dataset.
+	PFReject                       // Answers a packet of another protocol version. Carries no data.
 )
 
 // Represents a individual UDP packet. Fields in a packet byte slice listed in
@@ -25,24 +26,33 @@ const (
 //
 // > Data section:
 //   - Data, len(Packet) - 16 - len(header) bytes
+//
+// > Trailer section, on the wire only (see Seal and Unseal):
+//   - Version, 1 byte
+//   - Checksum, 4 bytes. CRC-32C over everything before it.
+//
+// The listener strips the trailer after checking it, so the packets it
+// processes end with the data.
 type Packet []byte
 
-func (this Packet) ClientId() []byte { return this[16:18] }
-func (this Packet) Flags() uint8     { return this[18] }
-func (this Packet) Sequence() uint16 { return uint16(this[19])<<8 | uint16(this[20]) }
+func (this Packet) ClientId() []byte { return this[addrSize+offClientId : addrSize+offClientId+2] }
+func (this Packet) Flags() uint8     { return this[addrSize+offFlags] }
+func (this Packet) Sequence() Seq {
+	return Seq(this[addrSize+offSequence])<<8 | Seq(this[addrSize+offSequence+1])
+}
 
 func (this Packet) SubSequence() (uint8, uint8) {
-	if this[18]&PFFragmented != 0 {
-		return this[21], this[22]
+	if this.Flags()&PFFragmented != 0 {
+		return this[addrSize+offFragIndex], this[addrSize+offFragCount]
 	}
 	return 0, 1
 }
 
 func (this Packet) Data() []byte {
-	if this[18]&PFFragmented != 0 {
-		return this[23:]
+	if this.Flags()&PFFragmented != 0 {
+		return this[addrSize+FragmentHeaderSize:]
 	}
-	return this[21:]
+	return this[addrSize+HeaderSize:]
 }
 
 func (this Packet) String() string {
@@ -78,6 +88,8 @@ func (this Packet) String() string {
 //     V1 = to_ipv6("123.123.123.123")            // = 16 bytes
 //     V2 = 192.168.1.2 & 0.0.255.255 = 1.2       // = 2 bytes
 //    Joe = md5(V1 + V2)                          // = 16 bytes
+//
+// Peer.Id of the sending peer is the base64 encoding of this value.
 func (this Packet) Owner() string {
 	// 16 byte ipv6 address + 2 byte client id
 	return string(md5hash(this[0:18]))
@@ -0,0 +1,565 @@
+package network
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// Writes captures as a pcapng file, which can be opened in Wireshark and
+// tcpdump. The link type is raw IP: every datagram gets a synthesised IPv4 or
+// IPv6 header and a UDP header, carrying the local and remote addresses. The
+// direction is stored in the epb_flags option of each packet.
+//
+// Addresses of transports which are not IP based (eg: MemoryNetwork
+// endpoints, Unix sockets) are written as IPv6 addresses derived from their
+// string form, with port 0. See addrIP.
+type PcapWriter struct {
+	w   io.Writer
+	buf []uint8
+}
+
+// pcapng block types, options and constants. See
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+const (
+	pcapSectionHeader  = 0x0A0D0D0A
+	pcapInterface      = 0x00000001
+	pcapEnhancedPacket = 0x00000006
+	pcapByteOrder      = 0x1A2B3C4D
+	pcapLinkTypeRaw    = 101 // LINKTYPE_RAW: the packet starts with an IPv4 or IPv6 header.
+	pcapOptEnd         = 0
+	pcapOptTsResol     = 9 // if_tsresol
+	pcapOptFlags       = 2 // epb_flags
+	pcapInbound        = 1 // Direction bits of epb_flags.
+	pcapOutbound       = 2
+)
+
+// Creates a writer and writes the file header to w.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	pw := &PcapWriter{w: w}
+
+	// Section header: byte order magic, version 1.0, unknown section length.
+	b := pw.block(pcapSectionHeader, 16)
+	binary.LittleEndian.PutUint32(b[8:], pcapByteOrder)
+	binary.LittleEndian.PutUint16(b[12:], 1)
+	binary.LittleEndian.PutUint16(b[14:], 0)
+	binary.LittleEndian.PutUint64(b[16:], ^uint64(0))
+	if err := pw.flush(); err != nil {
+		return nil, err
+	}
+
+	// One interface, with nanosecond timestamps.
+	b = pw.block(pcapInterface, 8+12)
+	binary.LittleEndian.PutUint16(b[8:], pcapLinkTypeRaw)
+	binary.LittleEndian.PutUint32(b[12:], 0) // No snapshot length limit.
+	binary.LittleEndian.PutUint16(b[16:], pcapOptTsResol)
+	binary.LittleEndian.PutUint16(b[18:], 1)
+	b[20] = 9
+	if err := pw.flush(); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// Starts a block with a body of n bytes in the scratch buffer. The body starts
+// at offset 8 and is padded to 32 bits.
+func (this *PcapWriter) block(kind uint32, n int) []uint8 {
+	size := 12 + (n+3)&^3
+	if cap(this.buf) < size {
+		this.buf = make([]uint8, size)
+	}
+
+	b := this.buf[:size]
+	for i := range b {
+		b[i] = 0
+	}
+
+	binary.LittleEndian.PutUint32(b[0:], kind)
+	binary.LittleEndian.PutUint32(b[4:], uint32(size))
+	binary.LittleEndian.PutUint32(b[size-4:], uint32(size))
+	this.buf = b
+	return b
+}
+
+func (this *PcapWriter) flush() error {
+	_, err := this.w.Write(this.buf)
+	return err
+}
+
+func (this *PcapWriter) WriteCapture(c *Capture) error {
+	src, dst := c.Remote, c.Local
+	flags := uint32(pcapInbound)
+	if !c.Inbound {
+		src, dst = dst, src
+		flags = pcapOutbound
+	}
+
+	ip := ipHeaderSize(src, dst)
+	size := ip + 8 + len(c.Data)
+	padded := (size + 3) &^ 3
+
+	// Interface id, timestamp, lengths, packet, epb_flags option, end of options.
+	b := this.block(pcapEnhancedPacket, 20+padded+8+4)
+
+	ts := uint64(c.Time.UnixNano())
+	binary.LittleEndian.PutUint32(b[12:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(b[16:], uint32(ts))
+	binary.LittleEndian.PutUint32(b[20:], uint32(size))
+	binary.LittleEndian.PutUint32(b[24:], uint32(size))
+
+	putIPUDP(b[28:28+size], src, dst, c.Data)
+
+	opt := b[28+padded:]
+	binary.LittleEndian.PutUint16(opt[0:], pcapOptFlags)
+	binary.LittleEndian.PutUint16(opt[2:], 4)
+	binary.LittleEndian.PutUint32(opt[4:], flags)
+	return this.flush()
+}
+
+// Returns the size of the IP header for a datagram between the given
+// addresses: 20 if both are IPv4 addresses, 40 otherwise.
+func ipHeaderSize(src, dst net.Addr) int {
+	if ip4(src) != nil && ip4(dst) != nil {
+		return 20
+	}
+	return 40
+}
+
+func ip4(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a.IP.To4()
+	}
+	return nil
+}
+
+func port(addr net.Addr) uint16 {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return uint16(a.Port)
+	}
+	return 0
+}
+
+// Writes an IP header, UDP header and data to b, which must be exactly large
+// enough to hold them.
+func putIPUDP(b []uint8, src, dst net.Addr, data []uint8) {
+	var sum uint32
+	var udp []uint8
+
+	if ipHeaderSize(src, dst) == 20 {
+		b[0] = 0x45 // Version 4, 5 words.
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		binary.BigEndian.PutUint16(b[6:], 0x4000) // Don't fragment.
+		b[8] = 64                                 // TTL
+		b[9] = 17                                 // UDP
+		copy(b[12:16], ip4(src))
+		copy(b[16:20], ip4(dst))
+		binary.BigEndian.PutUint16(b[10:], ^fold(checksum(0, b[:20])))
+
+		udp = b[20:]
+		sum = checksum(0, b[12:20])
+	} else {
+		b[0] = 0x60 // Version 6.
+		binary.BigEndian.PutUint16(b[4:], uint16(len(b)-40))
+		b[6] = 17 // UDP
+		b[7] = 64 // Hop limit
+		copy(b[8:24], addrIP(src))
+		copy(b[24:40], addrIP(dst))
+
+		udp = b[40:]
+		sum = checksum(0, b[8:40])
+	}
+
+	binary.BigEndian.PutUint16(udp[0:], port(src))
+	binary.BigEndian.PutUint16(udp[2:], port(dst))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	udp[6], udp[7] = 0, 0
+	copy(udp[8:], data)
+
+	// Pseudo header: addresses, protocol and UDP length.
+	sum += 17 + uint32(len(udp))
+	c := ^fold(checksum(sum, udp))
+	if c == 0 {
+		c = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], c)
+}
+
+// Adds b to a ones' complement sum.
+func checksum(sum uint32, b []uint8) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) > 0 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+// Reads captures from a pcapng file with raw IP, IPv4, IPv6 or Ethernet link
+// types, such as the ones written by PcapWriter. Classic pcap files, as
+// written by tcpdump, are read as well. Only UDP datagrams are returned.
+// Packets without direction flags are considered inbound.
+type PcapReader struct {
+	r       io.Reader
+	order   binary.ByteOrder
+	ifaces  []pcapIface
+	classic bool // Set for a classic pcap file. Its one interface is ifaces[0].
+	buf     []uint8
+}
+
+type pcapIface struct {
+	linktype uint16
+	tsunit   time.Duration // Duration of one timestamp unit, if >= 1ns.
+	tsdiv    uint64        // Units per nanosecond, for resolutions finer than 1ns.
+}
+
+func NewPcapReader(r io.Reader) *PcapReader {
+	return &PcapReader{r: r, order: binary.LittleEndian}
+}
+
+func (this *PcapReader) ReadCapture() (*Capture, error) {
+	for {
+		if this.classic {
+			c, err := this.record()
+			if err != nil || c != nil {
+				return c, err
+			}
+			continue
+		}
+
+		var head [8]uint8
+		if _, err := io.ReadFull(this.r, head[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = ErrInvalidCapture
+			}
+			return nil, err
+		}
+
+		if this.classicHeader(head[:]) {
+			var rest [16]uint8
+			if _, err := io.ReadFull(this.r, rest[:]); err != nil {
+				return nil, ErrInvalidCapture
+			}
+
+			this.ifaces[0].linktype = uint16(this.order.Uint32(rest[12:]))
+			continue
+		}
+
+		kind := this.order.Uint32(head[0:])
+		if kind == pcapSectionHeader {
+			// The byte order of the section follows the block length.
+			var magic [4]uint8
+			if _, err := io.ReadFull(this.r, magic[:]); err != nil {
+				return nil, ErrInvalidCapture
+			}
+
+			switch {
+			case binary.LittleEndian.Uint32(magic[:]) == pcapByteOrder:
+				this.order = binary.LittleEndian
+			case binary.BigEndian.Uint32(magic[:]) == pcapByteOrder:
+				this.order = binary.BigEndian
+			default:
+				return nil, ErrInvalidCapture
+			}
+
+			this.ifaces = this.ifaces[:0]
+			if _, err := this.body(this.order.Uint32(head[4:]), 12); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		body, err := this.body(this.order.Uint32(head[4:]), 8)
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case pcapInterface:
+			this.addInterface(body)
+
+		case pcapEnhancedPacket:
+			if c := this.packet(body); c != nil {
+				return c, nil
+			}
+		}
+	}
+}
+
+// Reads the rest of a block of the given total size, of which read bytes have
+// been read already. Returns the body without the trailing length.
+func (this *PcapReader) body(size uint32, read int) ([]uint8, error) {
+	if size < 12 || size%4 != 0 || size > 1<<24 {
+		return nil, ErrInvalidCapture
+	}
+
+	n := int(size) - read
+	if cap(this.buf) < n {
+		this.buf = make([]uint8, n)
+	}
+
+	b := this.buf[:n]
+	if _, err := io.ReadFull(this.r, b); err != nil {
+		return nil, ErrInvalidCapture
+	}
+	return b[:n-4], nil
+}
+
+// Magic numbers of classic pcap files, as read in little endian order.
+const (
+	pcapClassicMicro     = 0xA1B2C3D4
+	pcapClassicNano      = 0xA1B23C4D
+	pcapClassicMicroSwap = 0xD4C3B2A1
+	pcapClassicNanoSwap  = 0x4D3CB2A1
+)
+
+// Checks for the magic number of a classic pcap file, and sets up the reader
+// for one if it is found.
+func (this *PcapReader) classicHeader(b []uint8) bool {
+	iface := pcapIface{tsunit: time.Microsecond}
+
+	switch binary.LittleEndian.Uint32(b) {
+	case pcapClassicMicro:
+		this.order = binary.LittleEndian
+	case pcapClassicNano:
+		this.order = binary.LittleEndian
+		iface.tsunit = time.Nanosecond
+	case pcapClassicMicroSwap:
+		this.order = binary.BigEndian
+	case pcapClassicNanoSwap:
+		this.order = binary.BigEndian
+		iface.tsunit = time.Nanosecond
+	default:
+		return false
+	}
+
+	this.classic = true
+	this.ifaces = append(this.ifaces[:0], iface)
+	return true
+}
+
+// Reads a packet record from a classic pcap file. Returns nil without an
+// error for packets which are not UDP datagrams.
+func (this *PcapReader) record() (*Capture, error) {
+	var head [16]uint8
+	if _, err := io.ReadFull(this.r, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrInvalidCapture
+		}
+		return nil, err
+	}
+
+	size := this.order.Uint32(head[8:])
+	if size > 1<<24 {
+		return nil, ErrInvalidCapture
+	}
+
+	if cap(this.buf) < int(size) {
+		this.buf = make([]uint8, size)
+	}
+
+	b := this.buf[:size]
+	if _, err := io.ReadFull(this.r, b); err != nil {
+		return nil, ErrInvalidCapture
+	}
+
+	iface := this.ifaces[0]
+	ts := uint64(this.order.Uint32(head[0:]))*uint64(time.Second/iface.tsunit) + uint64(this.order.Uint32(head[4:]))
+	return iface.decode(ts, b), nil
+}
+
+func (this *PcapReader) addInterface(b []uint8) {
+	if len(b) < 8 {
+		return
+	}
+
+	iface := pcapIface{linktype: this.order.Uint16(b[0:]), tsunit: time.Microsecond}
+
+	for opts := b[8:]; len(opts) >= 4; {
+		code := this.order.Uint16(opts[0:])
+		n := int(this.order.Uint16(opts[2:]))
+		if code == pcapOptEnd || len(opts) < 4+(n+3)&^3 {
+			break
+		}
+
+		if code == pcapOptTsResol && n >= 1 {
+			iface.tsunit, iface.tsdiv = tsResolution(opts[4])
+		}
+		opts = opts[4+(n+3)&^3:]
+	}
+
+	this.ifaces = append(this.ifaces, iface)
+}
+
+// Decodes an if_tsresol value. The high bit selects a power of 2 instead of
+// a power of 10.
+func tsResolution(v uint8) (unit time.Duration, div uint64) {
+	var units uint64 // Units per second.
+	if v&0x80 != 0 {
+		units = 1 << (v & 0x7f)
+	} else {
+		units = 1
+		for i := uint8(0); i < v; i++ {
+			units *= 10
+		}
+	}
+
+	if units <= 1e9 {
+		return time.Second / time.Duration(units), 0
+	}
+	return 0, units / 1e9
+}
+
+func (this *PcapReader) packet(b []uint8) *Capture {
+	if len(b) < 20 {
+		return nil
+	}
+
+	id := this.order.Uint32(b[0:])
+	if int(id) >= len(this.ifaces) {
+		return nil
+	}
+
+	iface := this.ifaces[id]
+	ts := uint64(this.order.Uint32(b[4:]))<<32 | uint64(this.order.Uint32(b[8:]))
+	size := int(this.order.Uint32(b[12:]))
+	if len(b) < 20+size {
+		return nil
+	}
+
+	c := iface.decode(ts, b[20:20+size])
+	if c == nil {
+		return nil
+	}
+
+	opts := b[20+size:]
+	if len(opts) >= 4 {
+		opts = b[20+(size+3)&^3:]
+	}
+
+	for len(opts) >= 4 {
+		code := this.order.Uint16(opts[0:])
+		n := int(this.order.Uint16(opts[2:]))
+		if code == pcapOptEnd || len(opts) < 4+(n+3)&^3 {
+			break
+		}
+
+		if code == pcapOptFlags && n == 4 && this.order.Uint32(opts[4:])&3 == pcapOutbound {
+			c.Inbound = false
+		}
+		opts = opts[4+(n+3)&^3:]
+	}
+
+	if !c.Inbound {
+		c.Local, c.Remote = c.Remote, c.Local
+	}
+	return c
+}
+
+// Decodes a captured packet with a timestamp in units of this interface, as
+// an inbound datagram. Returns nil if it is not a UDP datagram.
+func (this pcapIface) decode(ts uint64, b []uint8) *Capture {
+	src, dst, data := decodeIPUDP(this.linktype, b)
+	if data == nil {
+		return nil
+	}
+
+	c := new(Capture)
+	if this.tsdiv > 0 {
+		c.Time = time.Unix(0, int64(ts/this.tsdiv))
+	} else {
+		c.Time = time.Unix(0, int64(ts)*int64(this.tsunit))
+	}
+
+	c.Inbound = true
+	c.Remote, c.Local = src, dst
+	c.Data = append([]uint8(nil), data...)
+	return c
+}
+
+// Link types we can decode.
+const (
+	linkTypeEthernet = 1
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+)
+
+// Extracts the addresses and payload of a UDP datagram from a captured
+// packet. Returns a nil payload if it is not a UDP datagram.
+func decodeIPUDP(linktype uint16, b []uint8) (src, dst *net.UDPAddr, data []uint8) {
+	if linktype == linkTypeEthernet {
+		if len(b) < 14 {
+			return
+		}
+
+		ethertype := binary.BigEndian.Uint16(b[12:])
+		b = b[14:]
+
+		if ethertype == 0x8100 && len(b) >= 4 { // VLAN tag
+			ethertype = binary.BigEndian.Uint16(b[2:])
+			b = b[4:]
+		}
+
+		if ethertype != 0x0800 && ethertype != 0x86DD {
+			return
+		}
+	} else if linktype != pcapLinkTypeRaw && linktype != linkTypeIPv4 && linktype != linkTypeIPv6 {
+		return
+	}
+
+	if len(b) < 1 {
+		return
+	}
+
+	var udp []uint8
+	src, dst = new(net.UDPAddr), new(net.UDPAddr)
+
+	switch b[0] >> 4 {
+	case 4:
+		ihl := int(b[0]&0x0f) * 4
+		if len(b) < ihl || ihl < 20 || b[9] != 17 {
+			return nil, nil, nil
+		}
+
+		if total := int(binary.BigEndian.Uint16(b[2:])); total >= ihl && total <= len(b) {
+			b = b[:total]
+		}
+
+		src.IP = append(net.IP(nil), b[12:16]...)
+		dst.IP = append(net.IP(nil), b[16:20]...)
+		udp = b[ihl:]
+
+	case 6:
+		if len(b) < 40 || b[6] != 17 {
+			return nil, nil, nil
+		}
+
+		src.IP = append(net.IP(nil), b[8:24]...)
+		dst.IP = append(net.IP(nil), b[24:40]...)
+		udp = b[40:]
+
+	default:
+		return nil, nil, nil
+	}
+
+	if len(udp) < 8 {
+		return nil, nil, nil
+	}
+
+	if n := int(binary.BigEndian.Uint16(udp[4:])); n >= 8 && n <= len(udp) {
+		udp = udp[:n]
+	}
+
+	src.Port = int(binary.BigEndian.Uint16(udp[0:]))
+	dst.Port = int(binary.BigEndian.Uint16(udp[2:]))
+	return src, dst, udp[8:]
+}
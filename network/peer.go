@@ -3,42 +3,79 @@ package network
 import (
 	"bytes"
 	"encoding/base64"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // This type represents a function handler for dealing with incoming messages.
+// When data is a []uint8, it is only valid until the handler returns. Use
+// Retain to keep it around for longer.
 type MessageHandler func(client *Peer, msgtype uint8, data interface{})
 
 // This type represents a function handler for dealing with error messages.
+// Problems with received packets are reported as a *PacketError. Return true
+// to stop polling for incoming data. With more than one worker (see
+// Config.Workers), it may be called from several goroutines at once.
 type ErrorHandler func(err error) bool
 
 // This represents a unique client connecting to our machine. This structure
 // maintains some counters and buffers used for reliable identification and
 // caching of the data packets sent to/from said client.
 type Peer struct {
-	Id          string       // 24 byte base64 encoded Md5 hash identifying this peer.
-	clientId    []uint8      // 2 byte client id.
-	Addr        *net.UDPAddr // Public address for this peer.
-	Sequence    uint16       // This counter keeps track of the amount of packets we sent to the receiver.
-	latencydata [2]uint32    // Total Packet count and Total Packet rountrip time in microseconds for each PING request.
-	lastpacket  int64        // Last packet receive time. Used for timeout detection.
-	scratch     []uint8      // A temporary data buffer.
+	Id             string     // 24 byte base64 encoded Md5 hash identifying this peer.
+	clientId       []uint8    // 2 byte client id.
+	Addr           net.Addr   // Public address for this peer. The listener updates it as packets arrive. Guarded by the listener's lock.
+	Sequence       Seq        // This counter keeps track of the amount of packets we sent to the receiver. Guarded by outlock.
+	RemoteSequence Seq        // Highest sequence number we received from this peer, in serial number order.
+	lastpacket     int64      // Last packet receive time. Used for timeout detection.
+	owner          string     // Raw 16 byte address + 2 byte client id. Id is the hash of this.
+	host           *Peer      // The listener which knows this peer. nil for the listener itself.
+	cache          []*buffer  // Cache of packets received from this peer. Used when expecting a sequence.
+	fragbase       Seq        // Sequence number of the first fragment of the message in cache.
+	fragtime       int64      // Time the first fragment of the message in cache arrived.
+	fraglock       sync.Mutex // Guards cache, fragbase and fragtime.
+	stats          peerStats  // Connection statistics. See Stats.
+	clocksync      clockSync  // Estimated offset of this peer's clock. See ClockOffset.
+	pmtu           pathMTU    // Path MTU discovery. See Config.PathMTU.
+	cc             congestion // Limits the rate at which we send to this peer. See Config.Congestion.
+	bw             bandwidth  // Bandwidth limits of the traffic with this peer. See Config.PeerLimits.
+	outlock        sync.Mutex // Serialises the packets we send to this peer.
 
 	// Fields only used by a listening peer.
-	onMessage MessageHandler   // function pointer to a message handler.
-	onError   ErrorHandler     // function pointer to error handler
-	udp       *net.UDPConn     // Our UDP listener socket.
-	clients   map[string]*Peer // List of known clients we rceived data from in this session.
-	cache     []Packet         // Cache of packets. Used when expecting a sequence.
-	ticker    *time.Ticker     // Used for ping requests when this peer is functioning as a listener.
-	lock      *sync.Mutex      // Used to synchronise access to some peer fields.
-	timeout   uint16           // Number of seconds a client can remain unresponsive before we consider it 'disconnected'.
+	onMessage MessageHandler              // function pointer to a message handler.
+	onError   ErrorHandler                // function pointer to error handler
+	transport Transport                   // Our listener socket. A UDP socket unless set through Serve.
+	clients   map[string]*Peer            // List of known clients we rceived data from in this session.
+	owners    map[string]*Peer            // Same clients, keyed by owner. Lets us find them without hashing.
+	groups    map[string]map[string]*Peer // Named groups of known clients. See JoinGroup.
+	clock     Clock                       // Source of time. See SetClock.
+	log       *slog.Logger                // Receives structured records. See SetLogger.
+	stopPing  func()                      // Stops the periodic ping requests when this peer is functioning as a listener.
+	done      chan struct{}               // Closed when the listener is shutting down.
+	polled    chan struct{}               // Closed when the polling loop has exited.
+	running   int                         // Goroutines of ours which are busy, outside of a handler. Guarded by lock. See Close.
+	idle      *sync.Cond                  // Signalled when running drops to 0.
+	halted    atomic.Bool                 // Set when the ErrorHandler asked us to stop polling.
+	batch     int                         // Number of datagrams to read/write per call, if the transport supports it.
+	datagram  int                         // Largest datagram we receive, and probe for. See Config.MaxDatagramSize.
+	pathmtu   bool                        // Discover the path MTU of new clients. See Config.PathMTU.
+	newcc     func() CongestionController // Creates the congestion controllers of new clients. See Config.Congestion.
+	limits    limits                      // Bandwidth limits. See Config.Limits.
+	interval  int64                       // Config.PingInterval, in nanoseconds.
+	rejected  map[string]int64            // Time we last rejected a datagram from each address. Only used by the polling goroutine.
+	workers   []chan job                  // Queues of the packet processing workers. See Config.Workers.
+	working   sync.WaitGroup              // Tracks running workers.
+	bindOnce  sync.Once                   // Binds the socket of a peer which sends without listening.
+	bindErr   error                       // Result of bindOnce.
+	lock      *sync.Mutex                 // Used to synchronise access to some peer fields.
+	timeout   uint16                      // Number of seconds a client can remain unresponsive before we consider it 'disconnected'.
 }
 
 // Constructs a new Peer instance
-func NewPeer(addr *net.UDPAddr, clientid []uint8) (p *Peer, err error) {
+func NewPeer(addr net.Addr, clientid []uint8) (p *Peer, err error) {
 	if len(clientid) != 2 {
 		return nil, ErrInvalidClientID
 	}
@@ -46,11 +83,14 @@ func NewPeer(addr *net.UDPAddr, clientid []uint8) (p *Peer, err error) {
 	p = new(Peer)
 	p.clientId = clientid
 	p.Addr = addr
+	p.clock = SystemClock
+	p.lock = new(sync.Mutex)
 
 	var d []uint8
 	buf := bytes.NewBuffer(d)
-	buf.Write(addr.IP.To16())
+	buf.Write(addrIP(addr))
 	buf.Write(clientid)
+	p.owner = buf.String()
 
 	hash := md5hash(buf.Bytes())
 
@@ -71,7 +111,55 @@ func NewPeer(addr *net.UDPAddr, clientid []uint8) (p *Peer, err error) {
 // The timeout argument is the number of seconds we should allow a peer to
 // remain inactive before we consider it 'disconnected'.
 func (this *Peer) Listen(pinginterval uint64, timeout uint16, mh MessageHandler, eh ErrorHandler) (err error) {
-	if this.udp != nil {
+	return this.ListenConfig(listenConfig(pinginterval, timeout), mh, eh)
+}
+
+// Same as Listen, but takes its settings from cfg. If cfg.Transport is set,
+// it is used instead of a UDP socket on this.Addr. A nil config uses the
+// defaults.
+func (this *Peer) ListenConfig(cfg *Config, mh MessageHandler, eh ErrorHandler) (err error) {
+	if this.transport != nil {
+		return
+	}
+
+	if cfg != nil && cfg.Transport != nil {
+		return this.serve(cfg.Transport, cfg, mh, eh)
+	}
+
+	var addr *net.UDPAddr
+	if addr, err = net.ResolveUDPAddr("udp", this.Addr.String()); err != nil {
+		return
+	}
+
+	var conn *net.UDPConn
+	if conn, err = net.ListenUDP("udp", addr); err != nil {
+		return
+	}
+
+	if err = this.serve(conn, cfg, mh, eh); err != nil {
+		conn.Close()
+	}
+	return
+}
+
+// Same as Listen, but reads and writes through the given transport instead of
+// opening a UDP socket on this.Addr. The peer takes ownership of the transport
+// and closes it in Peer.Close.
+func (this *Peer) Serve(t Transport, pinginterval uint64, timeout uint16, mh MessageHandler, eh ErrorHandler) (err error) {
+	return this.serve(t, listenConfig(pinginterval, timeout), mh, eh)
+}
+
+// Translates the arguments of Listen and Serve into a Config.
+func listenConfig(pinginterval uint64, timeout uint16) *Config {
+	cfg := new(Config)
+	cfg.PingInterval = time.Duration(pinginterval)
+	cfg.Timeout = time.Duration(timeout) * time.Second
+	return cfg
+}
+
+// Starts polling the given transport and pinging known clients.
+func (this *Peer) serve(t Transport, cfg *Config, mh MessageHandler, eh ErrorHandler) (err error) {
+	if this.transport != nil {
 		return
 	}
 
@@ -83,30 +171,49 @@ func (this *Peer) Listen(pinginterval uint64, timeout uint16, mh MessageHandler,
 		return ErrInvalidErrorHandler
 	}
 
-	if pinginterval == 0 {
-		pinginterval = 1e10 // Every 10 seconds = default
+	cfg = cfg.withDefaults()
+
+	if cfg.Clock != nil {
+		this.clock = cfg.Clock
 	}
 
-	this.lock = new(sync.Mutex)
-	this.lock.Lock()
+	if cfg.Logger != nil {
+		this.log = cfg.Logger
+	}
+
+	if conn, ok := t.(*net.UDPConn); ok && cfg.BatchSize > 1 {
+		t = newBatchConn(conn)
+	}
 
-	if cap(this.scratch) == 0 {
-		this.scratch = make([]uint8, PacketSize-UdpHeaderSize)
+	if cfg.Capture != nil {
+		t = NewCaptureTransport(t, cfg.Capture, this.clock)
 	}
 
+	this.lock.Lock()
 	this.onMessage = mh
 	this.onError = eh
 	this.clients = make(map[string]*Peer)
-	this.ticker = time.NewTicker(time.Duration(pinginterval))
-	this.timeout = timeout
+	this.owners = make(map[string]*Peer)
+	this.groups = make(map[string]map[string]*Peer)
+	this.timeout = cfg.timeoutSeconds()
+	this.batch = cfg.BatchSize
+	this.datagram = cfg.MaxDatagramSize
+	this.pathmtu = cfg.PathMTU
+	this.newcc = cfg.Congestion
+	this.limits.start(cfg)
+	this.interval = int64(cfg.PingInterval)
+	this.rejected = make(map[string]int64)
+	this.idle = sync.NewCond(this.lock)
+	this.running = 1 // The polling goroutine.
+	this.startWorkers(cfg.Workers)
+	this.transport = t
+	this.done = make(chan struct{})
+	this.halted.Store(false)
+	this.polled = make(chan struct{})
+	this.stopPing = this.clock.Every(cfg.PingInterval, this.ping)
 	this.lock.Unlock()
 
-	if this.udp, err = net.ListenUDP("udp", this.Addr); err != nil {
-		return
-	}
-
-	go this.poll()
-	go this.ping()
+	go this.poll(t)
 	return
 }
 
@@ -117,377 +224,1191 @@ func (this *Peer) Listen(pinginterval uint64, timeout uint16, mh MessageHandler,
 // not going to be a problem. We could use milliseconds, but that would still
 // require a 64 bit integer. So the extra precision of microseconds adds no
 // extra cost.
+//
+// The timestamp is followed by a 16 bit fraction of the client's packets we
+// did not receive recently. Pongs carry the same report in the other
+// direction, so both sides learn their outbound loss. See Stats.LossOut.
+//
+// The pong echoes our timestamp, followed by the loss report and the times
+// at which the client received the ping and sent the pong. These four
+// timestamps let us estimate the offset of its clock. See ClockOffset.
 func (this *Peer) ping() {
 	var ms int64
-	var id string
+
+	if !this.enter() {
+		return // Closed, and the clock has not heard yet.
+	}
+	defer this.leave()
 
 	limit := int64(this.timeout) * 1e9
-	data := make([]uint8, 9)
-	data[0] = MsgPing
+	data := make([]uint8, 10)
 
-	for {
-		select {
-		case _ = <-this.ticker.C:
-			for id = range this.clients {
-				// Use this opportunity to make sure client has not timed out.
-				if time.Now().UnixNano()-this.clients[id].lastpacket > limit {
-					// This one has exceeded the non-response time limit. Consider it a lost cause.
-					this.onMessage(this.clients[id], MsgPeerDisconnected, nil)
-
-					this.lock.Lock()
-					delete(this.clients, id)
-					this.lock.Unlock()
-					continue
-				}
+	for _, client := range this.Clients() {
+		now := this.clock.Now().UnixNano()
 
-				// Send current time in microseconds to client.
-				ms = time.Now().UnixNano() / 1e3
-
-				data[1] = uint8(ms >> 56)
-				data[2] = uint8(ms >> 48)
-				data[3] = uint8(ms >> 40)
-				data[4] = uint8(ms >> 32)
-				data[5] = uint8(ms >> 24)
-				data[6] = uint8(ms >> 16)
-				data[7] = uint8(ms >> 8)
-				data[8] = uint8(ms)
-				this.send(this.clients[id].Addr, data, MsgPing)
-			}
+		this.lock.Lock()
+		last := client.lastpacket
+		addr := client.Addr
+		this.lock.Unlock()
+
+		// Use this opportunity to make sure client has not timed out.
+		if now-last > limit {
+			// This one has exceeded the non-response time limit. Consider it a lost cause.
+			this.logPeer(slog.LevelInfo, "Peer disconnected", client, slog.String("reason", "timeout"))
+			this.notify(client, MsgPeerDisconnected, nil)
+
+			this.lock.Lock()
+			this.removeClient(client.Id)
+			this.lock.Unlock()
+			continue
+		}
+
+		// Send current time in microseconds to client.
+		ms = now / 1e3
+
+		putTimestamp(data, ms)
+
+		this.expireFragments(client, now)
+
+		loss := client.stats.lossReport()
+		data[8] = uint8(loss >> 8)
+		data[9] = uint8(loss)
+		this.send(client, addr, data, MsgPing)
+
+		if size := client.pmtu.next(now, last); size > 0 {
+			this.probe(client, size)
 		}
 	}
 }
 
 func (this *Peer) LocalAddr() net.Addr {
-	if this.udp != nil {
-		return this.udp.LocalAddr()
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.transport != nil {
+		return this.transport.LocalAddr()
 	} else {
 		return nil
 	}
 }
 
-// Poll for incoming data
-func (this *Peer) poll() {
+// Poll for incoming data. If the transport supports it, we read a batch of
+// datagrams per call.
+func (this *Peer) poll(t Transport) {
 	var err error
-	var size int
-	var addr *net.UDPAddr
+	var count int
 	var stamp int64
-	var i int
 
-	datasize := PacketSize - 6 // = PacketSize-UdpHeader+len(ipv6(addr))
-	data := make([]uint8, datasize, datasize)
+	defer close(this.polled)
+	defer this.working.Wait()
+	defer this.leave() // Close need not wait for the workers through us.
+	defer this.stopWorkers()
+
+	bt, _ := t.(BatchTransport)
+	size := 1
+	if bt != nil && this.batch > 1 {
+		size = this.batch
+	}
+
+	// Room for the 16 byte address and the largest datagram we may get.
+	datasize := 16 + PacketSize - UdpHeaderSize
+	if 16+this.datagram > datasize {
+		datasize = 16 + this.datagram
+	}
+	bufs := make([][]uint8, size)
+	msgs := make([]Datagram, size)
+
+	for i := range bufs {
+		bufs[i] = make([]uint8, datasize)
+		msgs[i].Buffer = bufs[i][16:] // leave room for 16-byte address
+	}
 
 loop:
-	for this.udp != nil {
-		size, addr, err = this.udp.ReadFromUDP(data[16:]) // leave room for 16-byte address
-		stamp = time.Now().UnixNano()
+	for {
+		if size > 1 {
+			count, err = bt.ReadBatch(msgs)
+		} else {
+			count = 1
+			msgs[0].N, msgs[0].Addr, err = t.ReadFrom(msgs[0].Buffer)
+		}
 
-		switch {
-		case err != nil:
-			if this.onError(err) {
+		stamp = this.clock.Now().UnixNano()
+
+		if err != nil {
+			select {
+			case <-this.done:
+				break loop // Peer.Close() was called.
+			default:
+			}
+
+			if this.report(err) {
 				break loop
 			}
-		case size < 6: // Need 5 byte msg header + at least 1 byte data (msg id)
-			if this.onError(ErrInvalidPacket) {
+			continue
+		}
+
+		for i := 0; i < count; i++ {
+			putAddrIP(bufs[i], msgs[i].Addr)
+			packet := Packet(bufs[i][0 : msgs[i].N+16])
+
+			if !this.verify(msgs[i].Addr, packet) {
+				// Garbage, or another protocol version.
+			} else if packet = packet[:len(packet)-TrailerSize]; len(packet) < 16+6 { // Need 5 byte msg header + at least 1 byte data (msg id)
+				this.drop(nil, msgs[i].Addr, packet, ErrInvalidPacket, "packet too short")
+			} else if !this.limits.receive.allow(stamp, msgs[i].N, this.limits.total.Receive) {
+				this.drop(nil, msgs[i].Addr, packet, ErrReceiveRate, "rate limit")
+			} else if len(this.workers) > 0 {
+				this.dispatch(msgs[i].Addr, packet, stamp)
+			} else {
+				this.process(msgs[i].Addr, packet, stamp)
+			}
+
+			// Workers report errors too, so this may be noticed a
+			// datagram late.
+			if this.halted.Load() {
 				break loop
 			}
-		default:
-			for i = 0; i < 16; i++ {
-				data[i] = addr.IP.To16()[i]
+		}
+	}
+}
+
+// Checks the trailer of a datagram. Datagrams with a bad checksum and those
+// of another protocol version are dropped. The latter are answered with a
+// PFReject packet, unless they are a rejection themselves or we answered the
+// same address recently. See mayReject.
+func (this *Peer) verify(addr net.Addr, packet Packet) bool {
+	if len(packet) < 16+HeaderSize+TrailerSize {
+		this.drop(nil, addr, packet, ErrInvalidPacket, "packet too short")
+		return false
+	}
+
+	version, ok := Unseal(packet[16:])
+	if !ok {
+		this.drop(nil, addr, packet, ErrInvalidPacket, "checksum mismatch")
+		return false
+	}
+
+	if version != ProtocolVersion {
+		if packet.Flags()&PFReject == 0 && this.mayReject(addr) {
+			var reject [HeaderSize + TrailerSize]uint8
+			reject[offClientId] = this.clientId[0]
+			reject[offClientId+1] = this.clientId[1]
+			reject[offFlags] = PFReject
+			Seal(reject[:])
+			this.sendToSocket(addr, reject[:])
+		}
+
+		this.drop(nil, addr, packet, ErrVersionMismatch, "version mismatch")
+		return false
+	}
+	return true
+}
+
+// Most addresses we remember rejecting. Beyond that, datagrams of another
+// protocol version go unanswered until the oldest entries expire.
+const maxRejected = 1024
+
+// Reports whether we may answer a datagram from addr with a rejection. Each
+// address gets at most one per ping interval. The source of a datagram is easy
+// to forge, so this keeps us from flooding someone else with our answers.
+func (this *Peer) mayReject(addr net.Addr) bool {
+	now := this.clock.Now().UnixNano()
+	key := addr.String()
+
+	if last, ok := this.rejected[key]; ok && now-last < this.interval {
+		return false
+	}
+
+	if len(this.rejected) >= maxRejected {
+		for k, last := range this.rejected {
+			if now-last >= this.interval {
+				delete(this.rejected, k)
 			}
-			this.process(addr, data[0:size+16], stamp)
+		}
+
+		if len(this.rejected) >= maxRejected {
+			return false
 		}
 	}
+
+	this.rejected[key] = now
+	return true
 }
 
-func (this *Peer) process(addr *net.UDPAddr, packet Packet, stamp int64) {
+func (this *Peer) process(addr net.Addr, packet Packet, stamp int64) {
 	var client *Peer
 	var ok bool
 	var data []uint8
+	var held [3]*buffer // Pooled buffers holding data. Released once it has been handled.
 
-	id := packet.Owner()
+	defer func() {
+		for _, b := range held {
+			b.release()
+		}
+	}()
 
-	// Create or update peer (owner of packet).
-	if client, ok = this.clients[id]; !ok {
-		client, _ = NewPeer(addr, packet.ClientId())
+	// Create or update peer (owner of packet). The lookup by the raw owner
+	// bytes does not allocate, so we only compute the hashed id for new peers.
+	this.lock.Lock()
+	if client, ok = this.owners[string(packet[0:18])]; !ok {
+		// The packet lives in the poll buffer, so copy the client id out.
+		clientid := []uint8{packet.ClientId()[0], packet.ClientId()[1]}
+		client, _ = NewPeer(addr, clientid)
+		client.host = this
+		this.clients[client.Id] = client
+		this.owners[client.owner] = client
+
+		if this.pathmtu {
+			client.pmtu.start(this.datagram)
+		}
 
-		this.lock.Lock()
-		this.clients[id] = client
-		this.lock.Unlock()
+		if this.newcc != nil {
+			client.cc.start(this.newcc(), stamp)
+		}
+		client.lastpacket = stamp
+	}
+	this.lock.Unlock()
+
+	// Packets beyond the limit are not counted as received, so the peer
+	// learns about them through its loss reports.
+	if !client.bw.receive.allow(stamp, len(packet)-16+TrailerSize, this.limits.peer.Receive) {
+		this.drop(client, addr, packet, ErrReceiveRate, "rate limit")
+		return
+	}
 
-		this.onMessage(this.clients[id], MsgPeerConnected, nil)
+	if !client.stats.received(packet.Sequence(), len(packet)-16) {
+		// A duplicate, made by the network or replayed by someone else.
+		this.logPacket(slog.LevelDebug, "Duplicate packet", client, addr, packet, "duplicate")
+		return
 	}
 
+	// Only packets we accept keep the peer alive, or move it to another
+	// address. A replayed one might come from anywhere.
 	this.lock.Lock()
 	client.Addr = addr
-	client.Sequence = packet.Sequence()
+	if !ok || client.RemoteSequence.Less(packet.Sequence()) {
+		client.RemoteSequence = packet.Sequence()
+	}
 	client.lastpacket = stamp
 	this.lock.Unlock()
+	this.stats.total(len(packet) - 16)
+
+	if !ok {
+		// Continue from the packets we sent to this address before we knew
+		// the peer (eg: Dial handshakes), so they are not taken for
+		// duplicates of the next ones.
+		this.outlock.Lock()
+		seq := this.Sequence
+		this.outlock.Unlock()
+
+		client.outlock.Lock()
+		if client.Sequence.Less(seq) {
+			client.Sequence = seq
+		}
+		client.outlock.Unlock()
 
-	if len(packet) > 22 {
+		this.logPeer(slog.LevelInfo, "Peer connected", client)
+		this.notify(client, MsgPeerConnected, nil)
+	}
+
+	if len(packet) > 21 { // 16 byte address + 5 byte header + message type
 		if packet[18]&PFFragmented != 0 {
+			if len(packet) <= 23 { // 2 more header bytes for fragments
+				this.drop(client, addr, packet, ErrInvalidPacket, "packet too short")
+				return
+			}
+
 			// This packet is part of a sequence. We need to store it and
 			// make sure we get all of them. We can then reassemble the
 			// original dataset.
-
 			s1, s2 := packet.SubSequence()
-			this.lock.Lock()
-			if int(s2) > len(this.cache) {
-				this.cache = make([]Packet, s2)
+			if s1 >= s2 {
+				this.drop(client, addr, packet, ErrInvalidPacket, "invalid fragment index")
+				return
 			}
-			this.cache[s1] = packet
-			this.lock.Unlock()
 
-			// Check if we have all of them
-			var i int
-			for i = range this.cache {
-				if this.cache[i] == nil {
-					return // Not yet. Stop processing
-				}
+			var stale bool
+			if held[0], stale = this.defragment(client, packet, stamp); stale {
+				// A late fragment of a message we have given up on, or
+				// a duplicate of one already delivered.
+				this.drop(client, addr, packet, ErrInvalidPacket, "stale fragment")
+				return
 			}
 
-			// We have all members of the sequence. Reassemble it.
-			buf := bytes.NewBuffer(data)
-
-			this.lock.Lock()
-			for i = range this.cache {
-				buf.Write(this.cache[i].Data())
-				this.cache[i] = nil
+			if held[0] == nil {
+				return // Not yet. Stop processing
 			}
-
-			this.cache = this.cache[0:0]
-			this.lock.Unlock()
-
-			data = buf.Bytes()
+			data = held[0].b
 		} else {
 			data = packet.Data()
 		}
 
 		// Decrypt if necessary.
 		if packet[18]&PFEncrypted != 0 && Encryption != nil {
-			data = Encryption.Decrypt(id, data)
+			if ae, ok := Encryption.(AppendEncrypter); ok {
+				held[1] = getBuffer(len(data))
+				held[1].b = ae.AppendDecrypt(held[1].b[:0], client.Id, data)
+				data = held[1].b
+			} else {
+				data = Encryption.Decrypt(client.Id, data)
+			}
 		}
 
 		// Decompress if necessary.
 		if packet[18]&PFCompressed != 0 && Compression != nil {
-			data = Compression.Decompress(data)
+			if ac, ok := Compression.(AppendCompressor); ok {
+				held[2] = getBuffer(2 * len(data))
+				held[2].b = ac.AppendDecompress(held[2].b[:0], data)
+				data = held[2].b
+			} else {
+				data = Compression.Decompress(data)
+			}
 		}
 
 		// Check if we got a packet used by this lib internally (eg: ping).
 		// These don't have to be forwarded to the host app.
 		if len(data) > 0 {
 			switch data[0] {
-			case MsgPing: // respond with supplied timestamp
-				data[0] = MsgPong
-				this.send(addr, data[1:], MsgPong)
+			case MsgPing: // respond with supplied timestamp, our loss report and our clock
+				if len(data) < 9 {
+					this.drop(client, addr, packet, ErrInvalidPacket, "truncated ping")
+					return
+				}
+
+				if len(data) >= 11 {
+					client.stats.reported(uint16(data[9])<<8 | uint16(data[10]))
+				}
+
+				var pong [26]uint8
+				copy(pong[:], data[1:9])
+
+				loss := client.stats.lossReport()
+				pong[8] = uint8(loss >> 8)
+				pong[9] = uint8(loss)
+
+				putTimestamp(pong[10:], stamp/1e3)
+				putTimestamp(pong[18:], this.clock.Now().UnixNano()/1e3)
+				this.send(client, addr, pong[:], MsgPong)
+				return
+
+			case MsgConnect: // Handshake from a dialing client. Let it know we are here.
+				this.send(client, addr, nil, MsgAccept)
+				return
+
+			case MsgAccept: // The MsgPeerConnected for this peer has already been sent.
+				return
+
+			case MsgProbe: // Path MTU probe. Tell the sender it got through.
+				if len(data) < 3 {
+					this.drop(client, addr, packet, ErrInvalidPacket, "truncated probe")
+					return
+				}
+				this.send(client, addr, data[1:3], MsgProbeAck)
+				return
+
+			case MsgProbeAck:
+				if len(data) < 3 {
+					this.drop(client, addr, packet, ErrInvalidPacket, "truncated probe")
+					return
+				}
+
+				size := client.pmtu.get()
+				client.pmtu.ack(int(data[1])<<8 | int(data[2]))
+				if mtu := client.pmtu.get(); mtu != size {
+					this.logPeer(slog.LevelDebug, "Path MTU", client, slog.Int("size", mtu))
+				}
 				return
 
 			case MsgPong: // Calculate latency from packet rounttrip time.
-				cms := time.Now().UnixNano() / 1e3
-				oms := int64(data[1])<<56 | int64(data[2])<<48 | int64(data[3])<<40 |
-					int64(data[4])<<32 | int64(data[5])<<24 | int64(data[6])<<16 |
-					int64(data[7])<<8 | int64(data[8])
-
-				// We average the latency out over the last 10 ping requests.
-				this.lock.Lock()
-				if client.latencydata[0] >= 10 {
-					client.latencydata[0] = 0
-					client.latencydata[1] = 0
+				if len(data) < 9 {
+					this.drop(client, addr, packet, ErrInvalidPacket, "truncated pong")
+					return
 				}
 
-				client.latencydata[0]++
-				client.latencydata[1] += uint32(cms - oms)
-				this.lock.Unlock()
+				cms := this.clock.Now().UnixNano() / 1e3
+				oms := getTimestamp(data[1:])
+				rtt := time.Duration(cms-oms) * time.Microsecond
 
-				this.onMessage(client, MsgLatency, uint16(client.latencydata[1]/client.latencydata[0]))
+				// With the client's timestamps, we can leave out the time it
+				// took to answer, and estimate the offset of its clock.
+				if len(data) >= 27 {
+					rtt = client.clocksync.sample(oms, getTimestamp(data[11:]), getTimestamp(data[19:]), cms)
+				}
+
+				// The sample is smoothed into the connection statistics.
+				// We report the smoothed round trip time.
+				client.stats.rtt(rtt)
+				this.stats.observe(rtt)
+
+				if len(data) >= 11 {
+					client.stats.reported(uint16(data[9])<<8 | uint16(data[10]))
+				}
+
+				st := client.Stats()
+				client.cc.update(cms*1e3, rtt, st.LossOut)
+				this.notify(client, MsgLatency, st.RTT)
 			default:
-				this.onMessage(client, data[0], data[1:])
+				// The data is only valid until the handler returns. See Retain.
+				this.notify(client, data[0], data[1:])
 			}
 		} else {
-			return //ErrNoData
+			this.drop(client, addr, packet, ErrNoData, "no data")
+			return
 		}
 	} else {
-		return //ErrInvalidPacket
+		this.drop(client, addr, packet, ErrInvalidPacket, "packet too short")
+		return
 	}
 }
 
-// Close the listener
-func (this *Peer) Close() {
-	this.lock.Lock()
+// Counts, logs and reports an invalid packet which we discard. The client is
+// nil if the packet could not be attributed to a peer. The error handler gets
+// a *PacketError wrapping err.
+func (this *Peer) drop(client *Peer, addr net.Addr, packet Packet, err error, reason string) {
+	this.stats.dropped()
+	if client != nil {
+		client.stats.dropped()
+	}
+
+	this.logPacket(slog.LevelWarn, "Dropped packet", client, addr, packet, reason)
+
+	pe := &PacketError{Err: err, Addr: addr}
+	if client != nil {
+		pe.PeerId = client.Id
+	}
 
-	if this.ticker != nil {
-		this.ticker.Stop()
-		this.ticker = nil
+	// The packet starts with the 16 byte address. Copy what we have of the
+	// 5 or 7 byte header.
+	size := 5
+	if len(packet) > 18 && packet[18]&PFFragmented != 0 {
+		size = 7
 	}
 
-	if this.udp != nil {
-		this.udp.Close()
-		this.udp = nil
+	if n := len(packet) - 16; n < size {
+		size = n
 	}
 
-	// Give code some time to break out of polling loop
-	time.Sleep(1e9)
+	if size > 0 {
+		pe.Header = append([]uint8(nil), packet[16:16+size]...)
+	}
+
+	if size >= 5 {
+		pe.Sequence = packet.Sequence()
+	}
+
+	if this.report(pe) {
+		this.halted.Store(true)
+	}
+}
 
+// Hands a message to the MessageHandler, unless we are closed. While the
+// handler runs, Close does not wait for the calling goroutine, so the handler
+// may call it.
+func (this *Peer) notify(client *Peer, msgtype uint8, data interface{}) {
+	if this.pause() {
+		this.onMessage(client, msgtype, data)
+		this.resume()
+	}
+}
+
+// Hands an error to the ErrorHandler, unless we are closed, and returns its
+// verdict. Once closed, errors stop the caller. See notify.
+func (this *Peer) report(err error) bool {
+	if !this.pause() {
+		return true
+	}
+
+	stop := this.onError(err)
+	this.resume()
+	return stop
+}
+
+// Marks the calling goroutine as busy, so Close waits for it. Returns false
+// if we are closed, in which case it must not start any work.
+func (this *Peer) enter() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	select {
+	case <-this.done:
+		return false
+	default:
+		this.running++
+		return true
+	}
+}
+
+// Ends what enter started.
+func (this *Peer) leave() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.running--; this.running == 0 {
+		this.idle.Broadcast()
+	}
+}
+
+// Stops counting the calling goroutine as busy while it runs a handler.
+// Returns false if we are closed, in which case the handler must not be
+// called.
+func (this *Peer) pause() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	select {
+	case <-this.done:
+		return false
+	default:
+		if this.running--; this.running == 0 {
+			this.idle.Broadcast()
+		}
+		return true
+	}
+}
+
+// Counts the calling goroutine as busy again, after a handler returned. It
+// may be closed by now, but it will notice before calling the next one.
+func (this *Peer) resume() {
+	this.lock.Lock()
+	this.running++
 	this.lock.Unlock()
-	this.lock = nil
 }
 
-// This sends the given data to the given address. It takes care of building
-// the packets with accurate header information. If the length of the supplied
-// data exceeds the established packet size (minus the UDP + message headers),
-// it will also take care of the required packet fragmentation so all the
-// information is sent. If network.Compressed and/or network.Encrypted are set.
-// this will also make sure these operations are performed on the data.
-func (this *Peer) Send(addr *net.UDPAddr, data []uint8) (err error) {
-	return this.send(addr, data, MsgData)
+// Time after which an incomplete message is abandoned. Its fragments are sent
+// together, so they arrive within moments of each other, unless some got
+// lost. This is checked with every ping.
+const reassemblyTimeout = 5 * time.Second
+
+// Adds a fragment, received at time stamp, to the cache of a client. Once all
+// fragments of the message are in, it returns the reassembled message in a
+// pooled buffer. Each peer has its own cache. Packets from one peer are never
+// processed concurrently, but ping expires the messages which stay incomplete,
+// so the cache is locked.
+func (this *Peer) defragment(client *Peer, packet Packet, stamp int64) (buf *buffer, stale bool) {
+	client.fraglock.Lock()
+	defer client.fraglock.Unlock()
+
+	// Fragments are sent with consecutive sequence numbers, so this
+	// identifies the message they belong to.
+	s1, s2 := packet.SubSequence()
+	base := packet.Sequence() - Seq(s1)
+
+	if len(client.cache) > 0 && base.Less(client.fragbase) {
+		return nil, true
+	}
+
+	if len(client.cache) > 0 && (base != client.fragbase || int(s2) != len(client.cache)) {
+		// A new message started before the previous one was complete.
+		// Its missing fragments are not coming.
+		this.reassemblyFailed(client, "superseded")
+	}
+
+	if len(client.cache) == 0 {
+		client.fragbase = base
+		client.fragtime = stamp
+		if int(s2) <= cap(client.cache) {
+			client.cache = client.cache[:s2]
+		} else {
+			client.cache = make([]*buffer, s2)
+		}
+	}
+
+	// The packet lives in the poll buffer, so copy it.
+	client.cache[s1].release()
+	client.cache[s1] = getBuffer(len(packet))
+	copy(client.cache[s1].b, packet)
+
+	// Check if we have all of them
+	var i, size int
+	for i = range client.cache {
+		if client.cache[i] == nil {
+			return
+		}
+		size += len(Packet(client.cache[i].b).Data())
+	}
+
+	// We have all members of the sequence. Reassemble it.
+	buf = getBuffer(size)
+	data := buf.b[:0]
+
+	for i = range client.cache {
+		data = append(data, Packet(client.cache[i].b).Data()...)
+	}
+
+	client.dropFragments()
+	return
+}
+
+// Abandons the message in the cache of a client, if it is still incomplete
+// reassemblyTimeout after its first fragment arrived.
+func (this *Peer) expireFragments(client *Peer, now int64) {
+	client.fraglock.Lock()
+	defer client.fraglock.Unlock()
+
+	if len(client.cache) > 0 && now-client.fragtime > int64(reassemblyTimeout) {
+		this.reassemblyFailed(client, "timeout")
+	}
+}
+
+// Logs, counts and drops the incomplete message in the cache of a client.
+// Called with client.fraglock held.
+func (this *Peer) reassemblyFailed(client *Peer, reason string) {
+	this.logPeer(slog.LevelWarn, "Reassembly failed", client,
+		slog.Int("seq", int(client.fragbase)),
+		slog.Int("fragments", received(client.cache)),
+		slog.Int("total", len(client.cache)),
+		slog.String("reason", reason))
+
+	client.dropFragments()
+	client.stats.reassemblyFailed()
+	this.stats.reassemblyFailed()
+}
+
+// Returns the number of fragments in the cache.
+func received(cache []*buffer) (n int) {
+	for _, b := range cache {
+		if b != nil {
+			n++
+		}
+	}
+	return
+}
+
+// Releases the cached fragments of an incomplete message.
+func (this *Peer) dropFragments() {
+	for i := range this.cache {
+		this.cache[i].release()
+		this.cache[i] = nil
+	}
+	this.cache = this.cache[0:0]
 }
 
-func (this *Peer) send(addr *net.UDPAddr, data []uint8, msgtype uint8) (err error) {
+// Close the listener. This blocks until the ping requests have stopped and
+// the polling loop has exited. Packets still held back by the send limits are
+// discarded.
+//
+// Handlers which are still running are not waited for, so Close may be
+// called from a MessageHandler or ErrorHandler. Once it returns, no more
+// handlers are called.
+func (this *Peer) Close() {
+	this.lock.Lock()
+	stop := this.stopPing
+	this.stopPing = nil
+	if stop != nil {
+		close(this.done)
+	}
+	this.lock.Unlock()
+
+	if stop == nil {
+		return // Not listening, or already closed.
+	}
+
+	// The clock may be running our pings on this very goroutine. Pings
+	// which still come due see that we are done.
+	go stop()
+	this.transport.Close()
+
 	this.lock.Lock()
+	for this.running > 0 {
+		this.idle.Wait()
+	}
+	this.transport = nil
 	this.lock.Unlock()
 
-	if cap(this.scratch) == 0 {
-		this.scratch = make([]uint8, PacketSize-UdpHeaderSize)
+	// Packets held back by the send limits will never leave.
+	for _, p := range append(this.Clients(), this) {
+		p.outlock.Lock()
+		p.bw.discard()
+		p.outlock.Unlock()
+	}
+}
+
+// Sets the clock used for timestamps, latency measurements, timeouts and
+// ping requests. This must be called before Listen or Serve. Defaults to
+// SystemClock.
+func (this *Peer) SetClock(c Clock) {
+	if c == nil {
+		c = SystemClock
 	}
+	this.clock = c
+}
+
+// Sets the logger which receives structured records about connecting and
+// disconnecting peers, dropped packets and failed fragment reassemblies. This
+// must be called before Listen or Serve. Defaults to nil: nothing is logged.
+func (this *Peer) SetLogger(l *slog.Logger) {
+	this.log = l
+}
 
-	this.scratch[0] = this.clientId[0]
-	this.scratch[1] = this.clientId[1]
-	this.scratch[2] = 0
+// This sends the given data to this peer. When called on a remote peer handed
+// to us by a listener (through the message handler or GetClient), the data goes
+// out through the listener's socket, but it uses the remote peer's own outbound
+// sequence and encryption identity. When called on the listener itself, the
+// data is sent to the listener's own address.
+//
+// It takes care of building the packets with accurate header information. If
+// the length of the supplied data exceeds the established packet size (minus
+// the UDP + message headers), it will also take care of the required packet
+// fragmentation so all the information is sent. If network.Compression and/or
+// network.Encryption are set, this will also make sure these operations are
+// performed on the data.
+//
+// Send is safe for concurrent use, on the same peer or on different ones.
+func (this *Peer) Send(data []uint8) (err error) {
+	if this.host != nil {
+		return this.host.send(this, this.address(), data, MsgData)
+	}
+	return this.send(this, this.Addr, data, MsgData)
+}
 
-	if Compression != nil {
-		data = Compression.Compress(data)
-		this.scratch[2] |= PFCompressed
+// Returns the address of this peer. For a remote peer, the listener may
+// change it at any time, as packets arrive from a new address.
+func (this *Peer) address() net.Addr {
+	if this.host == nil {
+		return this.Addr
 	}
 
-	if Encryption != nil {
-		data = Encryption.Encrypt(this.Id, data)
-		this.scratch[2] |= PFEncrypted
+	this.host.lock.Lock()
+	defer this.host.lock.Unlock()
+	return this.Addr
+}
+
+// This sends the given data to an arbitrary address, using this peer's own
+// outbound sequence. If a known remote peer has that address, this is the
+// same as calling Send on it: a peer only gets packets from one of our
+// sequence counters, so it can tell duplicates apart.
+func (this *Peer) SendTo(addr net.Addr, data []uint8) (err error) {
+	if p := this.clientAt(addr); p != nil {
+		return this.send(p, addr, data, MsgData)
 	}
+	return this.send(this, addr, data, MsgData)
+}
 
-	if len(data) > PacketSize-UdpHeaderSize-5 {
-		// Packet fragmentation required because data exceeds available packet space.
-		this.scratch[2] |= PFFragmented
-		size := PacketSize - UdpHeaderSize - 8
+// Returns the known peer with the given address, or nil if there is none.
+func (this *Peer) clientAt(addr net.Addr) *Peer {
+	var key [16]uint8
+	putAddrIP(key[:], addr)
 
-		var cur, total uint8
-		total = uint8(len(data) / size)
+	this.lock.Lock()
+	defer this.lock.Unlock()
 
-		if len(data)%size > 0 {
-			total++
+	for _, p := range this.clients {
+		if p.owner[:16] == string(key[:]) && sameAddr(p.Addr, addr) {
+			return p
 		}
+	}
+	return nil
+}
 
-		// Build and send as many packets as needed.
-		for {
-			// FIXME(jimt): Handle wrapping of this.Sequence value if it exceeds uint16
+// Reports whether two addresses are the same, without allocating for UDP
+// addresses.
+func sameAddr(a, b net.Addr) bool {
+	ua, ok1 := a.(*net.UDPAddr)
+	ub, ok2 := b.(*net.UDPAddr)
+	if ok1 && ok2 {
+		return ua.Port == ub.Port && ua.IP.Equal(ub.IP)
+	}
+	return a.String() == b.String()
+}
 
-			this.scratch[3] = uint8(this.Sequence >> 8)
-			this.scratch[4] = uint8(this.Sequence)
-			if this.Sequence == 65535 { //attempt at seqeucnce wrap
-				this.Sequence = 0
-			} else {
-				this.Sequence++
-			}
+// Builds and sends the packets for the given message. The header carries our
+// own client id, while the sequence counter and encryption identity come from
+// dst: the peer we are talking to.
+func (this *Peer) send(dst *Peer, addr net.Addr, data []uint8, msgtype uint8) (err error) {
+	payload, flags, cbuf := compress(data, msgtype)
+	defer cbuf.release()
 
-			this.scratch[5] = cur
-			this.scratch[6] = total
-			this.scratch[7] = msgtype
-			cur++
+	payload, flags, ebuf := encrypt(dst.Id, payload, flags)
+	defer ebuf.release()
 
-			copy(this.scratch[8:], data)
-			if err = this.sendToSocket(addr, this.scratch[0:size+8]); err != nil {
-				return
-			}
-			data = data[size:]
+	limit := dst.pmtu.get()
+	if err = this.admit(dst, this.clock.Now().UnixNano(), payload, msgtype, limit); err != nil {
+		return
+	}
+	return this.transmit(dst, addr, payload, msgtype, flags, limit)
+}
 
-			if len(data) <= size {
-				break
-			}
+// Checks whether the bandwidth limits and the congestion controller of dst
+// let us send the finished payload at time now. Messages used by the library
+// itself are always let through: they are small, and the controller relies on
+// the pings.
+func (this *Peer) admit(dst *Peer, now int64, payload []uint8, msgtype uint8, limit int) error {
+	if msgtype != MsgData {
+		return nil
+	}
+
+	this.limits.lock.Lock()
+	delay := time.Duration(this.limits.delay)
+	this.limits.lock.Unlock()
+
+	if this.backlog(dst, now) > delay || !dst.cc.admit(now, wireSize(len(payload), limit)) {
+		return ErrSendRate
+	}
+	return nil
+}
+
+// Prepares the payload for a message. The message type is prepended to the
+// data before compression and encryption, so the receiver finds it at the
+// start of the reassembled, decrypted and decompressed dataset.
+//
+// The payload lives in the returned pooled buffer, which must be released
+// once the payload has been sent.
+func compress(data []uint8, msgtype uint8) (payload []uint8, flags uint8, buf *buffer) {
+	buf = getBuffer(len(data) + 1)
+	buf.b[0] = msgtype
+	copy(buf.b[1:], data)
+	payload = buf.b
+
+	if Compression == nil {
+		return
+	}
+
+	flags |= PFCompressed
+
+	if ac, ok := Compression.(AppendCompressor); ok {
+		out := getBuffer(len(payload))
+		out.b = ac.AppendCompress(out.b[:0], payload)
+		buf.release()
+		return out.b, flags, out
+	}
+
+	// The result may refer to buf, so we hold on to it.
+	payload = Compression.Compress(payload)
+	return
+}
+
+// Encrypts a payload produced by compress() for the given peer. If the
+// Encrypter supports it, the result lives in the returned pooled buffer, which
+// must be released once the payload has been sent.
+func encrypt(peerid string, payload []uint8, flags uint8) ([]uint8, uint8, *buffer) {
+	if Encryption == nil {
+		return payload, flags, nil
+	}
+
+	flags |= PFEncrypted
+
+	if ae, ok := Encryption.(AppendEncrypter); ok {
+		out := getBuffer(len(payload))
+		out.b = ae.AppendEncrypt(out.b[:0], peerid, payload)
+		return out.b, flags, out
+	}
+	return Encryption.Encrypt(peerid, payload), flags, nil
+}
+
+// Cuts the finished payload into packets of at most limit bytes, and sends
+// them to addr, using the outbound sequence of dst. Sends to the same peer are serialised, so its
+// packets leave in sequence order and the fragments of concurrent messages
+// are not interleaved. Sends to different peers do not block each other.
+//
+// Data packets which the send limits hold back are queued, and only get their
+// sequence numbers when they leave (see pace). Messages used by the library
+// itself skip the queue, so pings measure the path, not our queue.
+func (this *Peer) transmit(dst *Peer, addr net.Addr, payload []uint8, msgtype, flags uint8, limit int) (err error) {
+	dst.outlock.Lock()
+	defer dst.outlock.Unlock()
+
+	now := this.clock.Now().UnixNano()
+
+	if len(payload) <= limit-HeaderSize-TrailerSize {
+		// Single packet. Just send as-is
+		buf := getBuffer(len(payload) + HeaderSize + TrailerSize)
+		defer buf.release()
+
+		pkt := buf.b
+		pkt[0] = this.clientId[0]
+		pkt[1] = this.clientId[1]
+		pkt[2] = flags
+		copy(pkt[5:], payload)
+
+		if at, held := this.pace(dst, now, len(pkt), msgtype); held {
+			this.hold(dst, now, at, addr, pkt, 1)
+			this.count(dst, 1, len(pkt))
+			return
 		}
 
-		// Send any remaining data
-		if len(data) > 0 {
-			// FIXME(jimt): Handle wrapping of this.Sequence value if it exceeds uint16
-			this.scratch[3] = uint8(this.Sequence >> 8)
-			this.scratch[4] = uint8(this.Sequence)
-			if this.Sequence == 65535 { //attempt at seqeucnce wrap
-				this.Sequence = 0
-			} else {
-				this.Sequence++
-			}
+		// The counter wraps around. Receivers compare serial numbers.
+		dst.Sequence.put(pkt[offSequence:])
+		dst.Sequence++
+		Seal(pkt)
+
+		if err = this.sendToSocket(addr, pkt); err == nil {
+			this.count(dst, 1, len(pkt))
+		}
+		return
+	}
+
+	// Packet fragmentation required because data exceeds available packet space.
+	size := limit - FragmentHeaderSize - TrailerSize
+	step := size + FragmentHeaderSize + TrailerSize
+	total := len(payload) / size
+
+	if len(payload)%size > 0 {
+		total++
+	}
+
+	if total > 255 {
+		return ErrPayloadTooLarge
+	}
 
-			this.scratch[5] = cur
-			this.scratch[6] = total
-			this.scratch[7] = msgtype
-			copy(this.scratch[8:], data)
+	// Build as many packets as needed, so they can be sent in one go.
+	buf := getBuffer(len(payload) + total*(FragmentHeaderSize+TrailerSize))
+	defer buf.release()
 
-			return this.sendToSocket(addr, this.scratch[0:len(data)+8])
+	list := datagramPool.Get().(*[]Datagram)
+	defer datagramPool.Put(list)
+
+	msgs := (*list)[:0]
+
+	// Fragments need consecutive sequence numbers. They are taken when the
+	// first fragment leaves, now or from the queue.
+	var base Seq
+	stamped := false
+
+	for cur := 0; cur < total; cur++ {
+		pkt := buf.b[cur*step:]
+		if len(pkt) > step {
+			pkt = pkt[:step]
 		}
 
-	} else {
-		// Single packet. Just send as-is
+		pkt[0] = this.clientId[0]
+		pkt[1] = this.clientId[1]
+		pkt[2] = flags | PFFragmented
+		pkt[5] = uint8(cur)
+		pkt[6] = uint8(total)
 
-		// FIXME(jimt): Handle wrapping of this.Sequence value if it exceeds uint16
-		this.scratch[3] = uint8(this.Sequence >> 8)
-		this.scratch[4] = uint8(this.Sequence)
-		this.scratch[5] = msgtype
-			if this.Sequence == 65535 { //attempt at seqeucnce wrap
-			this.Sequence = 0
-		} else {
-			this.Sequence++
+		n := copy(pkt[7:len(pkt)-TrailerSize], payload[cur*size:])
+		pkt = pkt[0 : n+FragmentHeaderSize+TrailerSize]
+
+		at, held := this.pace(dst, now, len(pkt), msgtype)
+		if cur == 0 && !held {
+			base = dst.Sequence
+			dst.Sequence += Seq(total)
+			stamped = true
+		}
+
+		if stamped {
+			(base + Seq(cur)).put(pkt[offSequence:])
+			Seal(pkt)
+		}
+
+		switch {
+		case !held:
+			msgs = append(msgs, Datagram{Buffer: pkt, Addr: addr})
+		case cur == 0:
+			this.hold(dst, now, at, addr, pkt, total) // Numbers the whole message when it leaves.
+		default:
+			this.hold(dst, now, at, addr, pkt, 0) // Numbered already, or along with the first fragment.
 		}
-		copy(this.scratch[6:], data)
-		return this.sendToSocket(addr, this.scratch[0:len(data)+6])
 	}
+
+	if err = this.sendPackets(msgs); err == nil {
+		this.count(dst, total, len(payload)+total*(FragmentHeaderSize+TrailerSize))
+	}
+
+	// Do not keep the packets and address alive through the pool.
+	for i := range msgs {
+		msgs[i] = Datagram{}
+	}
+	*list = msgs[:0]
 	return
 }
 
+// Returns the number of bytes a payload of n bytes takes on the wire, when cut
+// into packets of at most limit bytes.
+func wireSize(n, limit int) int {
+	if n <= limit-HeaderSize-TrailerSize {
+		return n + HeaderSize + TrailerSize
+	}
+
+	size := limit - FragmentHeaderSize - TrailerSize
+	return n + (n+size-1)/size*(FragmentHeaderSize+TrailerSize)
+}
+
+// Records n packets of size bytes in total, sent to dst. They also count
+// towards our own totals.
+func (this *Peer) count(dst *Peer, n, size int) {
+	dst.stats.sent(n, size)
+	if dst != this {
+		this.stats.sent(n, size)
+	}
+}
+
 // Called from Peer.Send()
-func (this *Peer) sendToSocket(addr *net.UDPAddr, data []uint8) (err error) {
-	if this.udp != nil {
-		// If this is a listening peer, just reuse the existing connection for sending.
-		_, err = this.udp.WriteToUDP(data, addr)
-	} else {
-		// Otherwise, create a new one.
-		var conn *net.UDPConn
+func (this *Peer) sendToSocket(addr net.Addr, data []uint8) (err error) {
+	this.lock.Lock()
+	t := this.transport
+	this.lock.Unlock()
 
-		if conn, err = net.DialUDP("udp", nil, addr); err != nil {
+	if t == nil {
+		// This peer is not listening. Bind a socket of our own.
+		if t, err = this.bind(); err != nil {
 			return
 		}
+	}
+
+	_, err = t.WriteTo(data, addr)
+	return
+}
+
+// Sends several packets. Uses a single call if the transport supports
+// batches.
+func (this *Peer) sendPackets(msgs []Datagram) (err error) {
+	this.lock.Lock()
+	bt, ok := this.transport.(BatchTransport)
+	batch := this.batch
+	this.lock.Unlock()
 
-		defer conn.Close()
-		_, err = conn.WriteToUDP(data, addr)
+	if !ok || batch <= 1 {
+		for i := range msgs {
+			if err = this.sendToSocket(msgs[i].Addr, msgs[i].Buffer); err != nil {
+				return
+			}
+		}
+		return
 	}
 
+	for len(msgs) > 0 {
+		n := len(msgs)
+		if n > batch {
+			n = batch
+		}
+
+		if _, err = bt.WriteBatch(msgs[:n]); err != nil {
+			return
+		}
+		msgs = msgs[n:]
+	}
 	return
 }
 
+// Sets the handlers used by a peer which never called Listen or Serve. See
+// bind() for details.
+func (this *Peer) SetHandlers(mh MessageHandler, eh ErrorHandler) {
+	this.onMessage = mh
+	this.onError = eh
+}
+
+// A peer which sends data without listening first, gets a single UDP socket
+// bound to an ephemeral port on the first send. This socket is used for all
+// further traffic, and it is polled just like a listening socket. Pongs and
+// replies sent to us are processed and handed to the handlers registered with
+// SetHandlers. Without those, replies are only used internally (eg: latency
+// tracking) and errors are ignored. This makes a peer usable as a pure client,
+// without it having to listen on a public address.
+func (this *Peer) bind() (Transport, error) {
+	this.lock.Lock()
+	closed := this.done != nil && this.transport == nil
+	this.lock.Unlock()
+
+	if closed {
+		return nil, net.ErrClosed // Listener which has been closed.
+	}
+
+	this.bindOnce.Do(func() {
+		var conn *net.UDPConn
+		if conn, this.bindErr = net.ListenUDP("udp", nil); this.bindErr != nil {
+			return
+		}
+
+		mh, eh := this.onMessage, this.onError
+		if mh == nil {
+			mh = func(*Peer, uint8, interface{}) {}
+		}
+		if eh == nil {
+			eh = func(error) bool { return false }
+		}
+
+		if this.bindErr = this.serve(conn, nil, mh, eh); this.bindErr != nil {
+			conn.Close()
+		}
+	})
+
+	if this.bindErr != nil {
+		return nil, this.bindErr
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.transport == nil {
+		return nil, net.ErrClosed
+	}
+	return this.transport, nil
+}
+
 // Finds the known peer with the given ID
 func (this *Peer) GetClient(id string) *Peer {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	if p, ok := this.clients[id]; ok {
 		return p
 	}
 	return nil
 }
 
+// Returns all known peers.
+func (this *Peer) Clients() []*Peer {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	list := make([]*Peer, 0, len(this.clients))
+	for _, p := range this.clients {
+		list = append(list, p)
+	}
+	return list
+}
+
 // Check to see if the given clientid is still listed.
 func (this *Peer) HasClient(id string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	_, ok := this.clients[id]
 	return ok
 }
 
 // Adds a new peer to the list of known peers
 func (this *Peer) AddClient(p *Peer) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	if _, ok := this.clients[p.Id]; ok {
 		return
 	}
 
-	this.lock.Lock()
+	p.host = this
 	this.clients[p.Id] = p
-	this.lock.Unlock()
+	this.owners[p.owner] = p
+
+	if this.pathmtu {
+		p.pmtu.start(this.datagram)
+	}
+
+	if this.newcc != nil {
+		p.cc.start(this.newcc(), this.clock.Now().UnixNano())
+	}
 }
 
-// Removes the known peer with the given id
+// Removes the known peer with the given id. It is also removed from any
+// groups it was a member of.
 func (this *Peer) RemoveClient(id string) {
 	this.lock.Lock()
-	delete(this.clients, id)
+	this.removeClient(id)
 	this.lock.Unlock()
 }
+
+// Called with this.lock held.
+func (this *Peer) removeClient(id string) {
+	if p, ok := this.clients[id]; ok {
+		delete(this.owners, p.owner)
+	}
+	delete(this.clients, id)
+
+	for name, group := range this.groups {
+		delete(group, id)
+		if len(group) == 0 {
+			delete(this.groups, name)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// Bounds of the datagram size, without IP and UDP headers, used by path MTU
+// discovery. Every IPv4 path carries 576 byte packets. A 1500 byte Ethernet
+// frame is what most paths carry.
+const (
+	minDatagramSize     = 576 - 28
+	defaultDatagramSize = 1500 - 28
+)
+
+// Number of unanswered probes after which a size is considered too large for
+// the path (MAX_PROBES in RFC 8899).
+const maxProbes = 3
+
+// Time after which a completed search is repeated, to find out whether the
+// path now carries larger datagrams (PMTU_RAISE_TIMER in RFC 8899).
+const pmtuRaiseInterval = 10 * time.Minute
+
+// States of the search. See RFC 8899, section 5.2.
+const (
+	pmtuDisabled = iota // Discovery is off. Datagrams are limited by PacketSize.
+	pmtuBase            // Confirming that the path carries the base size.
+	pmtuSearch          // Probing for larger sizes.
+	pmtuComplete        // Search done. Probes keep confirming the size.
+)
+
+// Path MTU discovery for one peer, as the datagram packetization layer path
+// MTU discovery of RFC 8899. Probes are padded packets of the size to test.
+// The peer answers the ones it receives with MsgProbeAck. The listener sends a
+// probe along with every ping. One which is still unanswered at the next ping
+// is lost, unless the peer has not sent anything else in the meantime either.
+//
+// The search starts by confirming the size PacketSize allows. It then halves
+// the distance between the largest size which got through and the smallest
+// one which did not, upwards from there, or downwards from 548 bytes if the
+// base size does not get through. Once it is complete, the probes confirm the
+// size found, so a path which stops carrying it (a black hole) is noticed, and
+// the search starts over.
+type pathMTU struct {
+	lock     sync.Mutex
+	state    int
+	size     int   // Largest confirmed datagram size (PLPMTU).
+	base     int   // Size the search starts from (BASE_PLPMTU).
+	max      int   // Largest size we probe for.
+	low      int   // Largest size which got through.
+	high     int   // Largest size which did not fail yet.
+	probe    int   // Size of the outstanding probe. 0 if there is none.
+	sent     int64 // Time the outstanding probe was sent, in nanoseconds.
+	lost     int   // Number of lost probes of this size.
+	searched int64 // Time the search completed, in nanoseconds.
+}
+
+// Enables discovery of datagrams up to max bytes.
+func (this *pathMTU) start(max int) {
+	base := PacketSize - UdpHeaderSize
+	if base > max {
+		base = max
+	}
+
+	this.lock.Lock()
+	this.state = pmtuBase
+	this.size = base
+	this.base = base
+	this.max = max
+	this.low = base
+	this.high = max
+	this.lock.Unlock()
+}
+
+// Returns the largest datagram we can send to the peer, without IP and UDP
+// headers.
+func (this *pathMTU) get() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.state == pmtuDisabled {
+		return PacketSize - UdpHeaderSize
+	}
+	return this.size
+}
+
+// Returns the size of the probe to send at time now, or 0 if discovery is
+// off. The peer's last packet arrived at time last.
+func (this *pathMTU) next(now, last int64) int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.state == pmtuDisabled {
+		return 0
+	}
+
+	if this.probe != 0 && last >= this.sent {
+		if this.lost++; this.lost >= maxProbes {
+			this.failed()
+		}
+	}
+
+	switch this.state {
+	case pmtuSearch:
+		if this.low < this.high {
+			this.probe = (this.low + this.high + 1) / 2
+			break
+		}
+
+		this.state = pmtuComplete
+		this.searched = now
+		fallthrough
+
+	case pmtuComplete:
+		if now-this.searched >= int64(pmtuRaiseInterval) && this.size < this.max {
+			this.state = pmtuSearch
+			this.low = this.size
+			this.high = this.max
+			this.probe = (this.low + this.high + 1) / 2
+		} else {
+			this.probe = this.size
+		}
+
+	default:
+		this.probe = this.base
+	}
+
+	this.sent = now
+	return this.probe
+}
+
+// The outstanding probe was lost too often.
+func (this *pathMTU) failed() {
+	this.lost = 0
+
+	switch this.state {
+	case pmtuBase:
+		// Search below the base size. Every path carries the minimum.
+		this.state = pmtuSearch
+		this.size = minDatagramSize
+		this.low = minDatagramSize
+		this.high = this.base - 1
+
+	case pmtuSearch:
+		this.high = this.probe - 1
+
+	case pmtuComplete:
+		// A black hole. Start over.
+		this.state = pmtuBase
+		this.size = this.base
+		this.low = this.base
+		this.high = this.max
+	}
+}
+
+// Records the acknowledgement of a probe of the given size.
+func (this *pathMTU) ack(size int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.state == pmtuDisabled || size != this.probe {
+		return // Late, or not ours.
+	}
+
+	this.probe = 0
+	this.lost = 0
+
+	switch this.state {
+	case pmtuBase:
+		this.state = pmtuSearch
+		this.size = this.base
+		this.low = this.base
+
+	case pmtuSearch:
+		this.low = size
+		this.size = size
+	}
+}
+
+// Sends a path MTU probe of the given size to a client. It is sent without
+// compression and encryption, so the datagram has exactly that size.
+func (this *Peer) probe(client *Peer, size int) {
+	buf := getBuffer(size - HeaderSize - TrailerSize)
+	defer buf.release()
+
+	b := buf.b
+	clear(b)
+	b[0] = MsgProbe
+	b[1] = uint8(size >> 8)
+	b[2] = uint8(size)
+	this.transmit(client, client.address(), b, MsgProbe, 0, size)
+}
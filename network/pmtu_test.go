@@ -0,0 +1,114 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPathMTUSearch(t *testing.T) {
+	for _, path := range []int{minDatagramSize, 600, 1372, 1377, 1378, 1400, 1471, 1472} {
+		var m pathMTU
+		m.start(defaultDatagramSize)
+
+		// The peer answers every probe which fits through the path, and
+		// keeps sending other traffic.
+		var now int64
+		for i := 0; i < 100; i++ {
+			now++
+			if size := m.next(now, now); size <= path {
+				m.ack(size)
+			}
+		}
+
+		if got := m.get(); got != path {
+			t.Fatalf("Path of %d bytes: found %d", path, got)
+		}
+	}
+
+	// Without traffic from the peer, unanswered probes are not counted as
+	// lost.
+	var m pathMTU
+	m.start(defaultDatagramSize)
+	for i := 0; i < 10; i++ {
+		m.next(0, -1)
+	}
+
+	if m.state != pmtuBase || m.get() != PacketSize-UdpHeaderSize {
+		t.Fatalf("Expected the base size to stand, got %d", m.get())
+	}
+}
+
+func TestPathMTU(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	var peers []*Peer
+	var sims []*SimulatedTransport
+	var recs []*recorder
+	for i, addr := range []string{"10.0.0.1:7000", "10.0.0.2:7000"} {
+		cfg, sim := simulated(clock)
+		cfg.ErrorHandler = ignoreErrors
+		cfg.PathMTU = true
+
+		p, r := newMemoryPeer(t, n, clock, addr, uint8(i+1), nil, cfg)
+		defer p.Close()
+
+		peers = append(peers, p)
+		sims = append(sims, sim)
+		recs = append(recs, r)
+	}
+
+	a, b := peers[0], peers[1]
+	b.SendTo(a.Addr, []uint8("hello"))
+	n.Flush()
+
+	client := a.GetClient(b.Id)
+	if mtu := client.Stats().PathMTU; mtu != PacketSize-UdpHeaderSize {
+		t.Fatalf("Expected to start from PacketSize, got %d", mtu)
+	}
+
+	rounds := func(count int) {
+		for i := 0; i < count; i++ {
+			clock.Advance(time.Second)
+			n.Flush()
+		}
+	}
+
+	// Sends a message to b, and returns the number of packets it took.
+	message := func() int {
+		before := client.Stats().PacketsSent
+		data := bytes.Repeat([]uint8{'x'}, 2900)
+		client.Send(data)
+		n.Flush()
+
+		msgs := recs[1].take(MsgData)
+		if len(msgs) != 1 || !bytes.Equal(msgs[0].data.([]uint8), data) {
+			t.Fatalf("Expected the message to arrive, got %v", msgs)
+		}
+		return int(client.Stats().PacketsSent - before)
+	}
+
+	// A LAN: the whole Ethernet frame is available.
+	rounds(20)
+	if mtu := client.Stats().PathMTU; mtu != defaultDatagramSize {
+		t.Fatalf("Expected %d, got %d", defaultDatagramSize, mtu)
+	}
+
+	if c := message(); c != 2 {
+		t.Fatalf("Expected 2 fragments of up to %d bytes, got %d", defaultDatagramSize, c)
+	}
+
+	// The route changes to a tunnel with a smaller MTU. Confirmation probes
+	// go missing and the search starts over, below PacketSize.
+	sims[0].SetOutbound(Conditions{MTU: 1372})
+	rounds(60)
+
+	if mtu := client.Stats().PathMTU; mtu != 1372 {
+		t.Fatalf("Expected 1372, got %d", mtu)
+	}
+
+	if c := message(); c != 3 {
+		t.Fatalf("Expected 3 fragments of up to 1372 bytes, got %d", c)
+	}
+}
@@ -0,0 +1,85 @@
+package network
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Packet buffers are pooled, so sending and receiving does not allocate
+// memory for every packet. This comes with a few ownership rules:
+//
+//   - Data handed to a MessageHandler is only valid until the handler
+//     returns. Its memory is reused for subsequent packets. Handlers which
+//     need the data afterwards, must make a copy with Retain.
+//   - Data handed to Transport.WriteTo is only valid during the call.
+//     Transports which hold on to it (eg: to delay it) must make a copy.
+//   - Data handed to Peer.Send and friends remains owned by the caller. It
+//     can be reused as soon as the call returns.
+//   - Compressor and Encrypter implementations may return their input, or a
+//     slice of it. The library does not keep their output after the packet
+//     has been sent or handled. Implementations which also implement
+//     AppendCompressor or AppendEncrypter get to write into pooled buffers.
+
+// Returns a copy of data which remains valid after the MessageHandler it was
+// handed to returns.
+func Retain(data []uint8) []uint8 {
+	return append([]uint8(nil), data...)
+}
+
+// A pooled byte slice. We pass pointers to these around, rather than the
+// slices themselves, so returning them to the pool does not allocate.
+type buffer struct {
+	b []uint8
+}
+
+// Buffers are pooled in power of 2 size classes, from 64 bytes up to 1MB.
+// Fragmented messages can not exceed 255 packets, so larger buffers are rare.
+const (
+	minBufferClass = 6
+	maxBufferClass = 20
+)
+
+var bufferPools [maxBufferClass + 1]sync.Pool
+
+// Returns a buffer of length n. Its content is undefined.
+func getBuffer(n int) *buffer {
+	c := bufferClass(n)
+	if c > maxBufferClass {
+		return &buffer{b: make([]uint8, n)}
+	}
+
+	if v := bufferPools[c].Get(); v != nil {
+		buf := v.(*buffer)
+		buf.b = buf.b[:n]
+		return buf
+	}
+	return &buffer{b: make([]uint8, n, 1<<uint(c))}
+}
+
+// Returns the buffer to its pool. It must not be used afterwards. Calling
+// this on a nil buffer does nothing.
+func (this *buffer) release() {
+	if this == nil {
+		return
+	}
+
+	c := bufferClass(cap(this.b))
+	if c > maxBufferClass || cap(this.b) != 1<<uint(c) {
+		return // Not one of ours.
+	}
+
+	this.b = this.b[:0]
+	bufferPools[c].Put(this)
+}
+
+func bufferClass(n int) int {
+	if n <= 1<<minBufferClass {
+		return minBufferClass
+	}
+	return bits.Len(uint(n - 1))
+}
+
+// Pool of datagram lists, used to send fragmented messages in one go.
+var datagramPool = sync.Pool{
+	New: func() interface{} { return new([]Datagram) },
+}
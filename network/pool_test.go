@@ -0,0 +1,101 @@
+//go:build !race
+
+// The race detector randomly drops items from a sync.Pool, so allocations
+// can not be counted reliably when it is enabled.
+
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// A transport which discards everything written to it.
+type discardTransport struct {
+	Transport
+}
+
+func (this discardTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return len(b), nil
+}
+
+// Returns settings for newMemoryPeer under which the packets the peer sends
+// go nowhere, so sending them does not allocate on the memory network.
+func discarding() *peerConfig {
+	return &peerConfig{Wrap: func(tr Transport) Transport { return discardTransport{tr} }}
+}
+
+func TestBufferPool(t *testing.T) {
+	for _, n := range []int{0, 1, 64, 65, 1000, PacketSize, 1 << 20, 1<<20 + 1} {
+		buf := getBuffer(n)
+		if len(buf.b) != n {
+			t.Fatalf("getBuffer(%d): len %d", n, len(buf.b))
+		}
+		buf.release()
+	}
+
+	var nilbuf *buffer
+	nilbuf.release()
+}
+
+func TestSendAllocs(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	p, _ := newMemoryPeer(t, NewMemoryNetwork(), clock, "10.0.0.1:7000", 1, nil, discarding())
+	defer p.Close()
+
+	to := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7000}
+	small := make([]uint8, 100)
+	large := make([]uint8, 10*PacketSize)
+
+	for _, data := range [][]uint8{small, large} {
+		allocs := testing.AllocsPerRun(100, func() {
+			if err := p.SendTo(to, data); err != nil {
+				t.Fatalf("SendTo: %v", err)
+			}
+		})
+
+		if allocs != 0 {
+			t.Errorf("SendTo(%d bytes): %v allocations, want 0", len(data), allocs)
+		}
+	}
+}
+
+func TestProcessAllocs(t *testing.T) {
+	var got int
+	mh := func(_ *Peer, msgtype uint8, data interface{}) {
+		if msgtype == MsgData {
+			got += len(data.([]uint8))
+		}
+	}
+
+	clock := NewManualClock(time.Unix(1e9, 0))
+	p, _ := newMemoryPeer(t, NewMemoryNetwork(), clock, "10.0.0.1:7000", 1, mh, discarding())
+	defer p.Close()
+
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7000}
+	packet := make(Packet, 16+5+1+100)
+	putAddrIP(packet, from)
+	packet[17] = 2
+	packet[21] = MsgData
+
+	p.process(from, packet, 0) // First packet creates the peer.
+
+	// Duplicates are dropped, so each run sends the next sequence number.
+	var seq Seq
+	allocs := testing.AllocsPerRun(100, func() {
+		seq++
+		seq.put(packet[16+offSequence:])
+		p.process(from, packet, 0)
+	})
+
+	// Handing the data to the MessageHandler as an interface{} costs one
+	// allocation. The library itself should not add any.
+	if allocs > 1 {
+		t.Errorf("process: %v allocations, want at most 1", allocs)
+	}
+
+	if got == 0 {
+		t.Errorf("Message handler was not called")
+	}
+}
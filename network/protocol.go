@@ -0,0 +1,124 @@
+package network
+
+import "hash/crc32"
+
+// The wire format as data. The Packet accessors read the header through the
+// offsets below, and tools which decode traffic are driven by the tables:
+// gnarly-dump names flags and message types with them, and the Wireshark
+// dissector in network/wireshark is generated from them. A change to the
+// header belongs here, so they all follow.
+
+// Layout of the message header. Offsets are relative to the start of the
+// header, which follows the 16 byte address in a Packet.
+const (
+	addrSize           = 16 // Sender address, prepended to received packets. Not sent.
+	offClientId        = 0
+	offFlags           = 2
+	offSequence        = 3
+	offFragIndex       = 5
+	offFragCount       = 6
+	HeaderSize         = 5 // Size of the message header.
+	FragmentHeaderSize = 7 // Size of the message header of a fragment.
+	TrailerSize        = 5 // Size of the trailer: protocol version and checksum.
+	offVersion         = 0 // Offsets into the trailer.
+	offChecksum        = 1
+)
+
+// Version of the wire format. Every packet carries it in its trailer. Peers
+// discard packets of other versions, and answer them with a packet flagged
+// PFReject, so a client built against another version fails to Dial with
+// ErrVersionMismatch. Increment it with any incompatible change.
+const ProtocolVersion uint8 = 1
+
+// The trailer ends with a CRC-32C (Castagnoli) over the rest of the datagram,
+// header and version included. The checksum is seeded with the protocol name,
+// so stray UDP traffic and other protocols are discarded before processing.
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	crcSeed  = crc32.Update(0, crcTable, []uint8("gnarly"))
+)
+
+// Fills in the trailer, which takes up the last TrailerSize bytes of the
+// datagram b.
+func Seal(b []uint8) {
+	t := b[len(b)-TrailerSize:]
+	t[offVersion] = ProtocolVersion
+
+	sum := crc32.Update(crcSeed, crcTable, b[:len(b)-TrailerSize+offChecksum])
+	t[offChecksum] = uint8(sum >> 24)
+	t[offChecksum+1] = uint8(sum >> 16)
+	t[offChecksum+2] = uint8(sum >> 8)
+	t[offChecksum+3] = uint8(sum)
+}
+
+// Checks the trailer of the datagram b. Returns the protocol version of the
+// sender, and false if the checksum does not match.
+func Unseal(b []uint8) (version uint8, ok bool) {
+	if len(b) < TrailerSize {
+		return 0, false
+	}
+
+	t := b[len(b)-TrailerSize:]
+	sum := crc32.Update(crcSeed, crcTable, b[:len(b)-TrailerSize+offChecksum])
+	ok = t[offChecksum] == uint8(sum>>24) && t[offChecksum+1] == uint8(sum>>16) &&
+		t[offChecksum+2] == uint8(sum>>8) && t[offChecksum+3] == uint8(sum)
+	return t[offVersion], ok
+}
+
+// A field of the message header. Numbers are big endian.
+type HeaderField struct {
+	Name   string // Short name. The Wireshark field is gnarly.<Name>.
+	Title  string // Human readable name.
+	Offset int    // Offset into the header.
+	Size   int    // Size in bytes.
+	Hex    bool   // Displayed in hexadecimal, rather than decimal.
+	Flag   uint8  // If non-zero, the field is only present when this flag is set.
+}
+
+// The fields of the message header, in order.
+var HeaderFields = []HeaderField{
+	{"clientid", "Client ID", offClientId, 2, true, 0},
+	{"flags", "Flags", offFlags, 1, true, 0},
+	{"seq", "Sequence", offSequence, 2, false, 0},
+	{"frag_index", "Fragment index", offFragIndex, 1, false, PFFragmented},
+	{"frag_count", "Fragment count", offFragCount, 1, false, PFFragmented},
+}
+
+// The fields of the trailer, which ends every datagram. Offsets are relative
+// to the start of the trailer.
+var TrailerFields = []HeaderField{
+	{"version", "Protocol version", offVersion, 1, false, 0},
+	{"checksum", "Checksum", offChecksum, 4, true, 0},
+}
+
+// A named flag or message type.
+type ProtocolName struct {
+	Value uint8
+	Name  string
+	Title string
+}
+
+// The packet flags.
+var PacketFlags = []ProtocolName{
+	{PFCompressed, "compressed", "Compressed"},
+	{PFEncrypted, "encrypted", "Encrypted"},
+	{PFFragmented, "fragmented", "Fragmented"},
+	{PFReject, "reject", "Rejected"},
+}
+
+// The message types used by the library. The message type is the first byte
+// of the message data, after decryption and decompression. MsgPeerConnected,
+// MsgPeerDisconnected and MsgLatency are only reported to the host
+// application and never sent.
+var MessageTypes = []ProtocolName{
+	{MsgData, "MsgData", "Data"},
+	{MsgPing, "MsgPing", "Ping"},
+	{MsgPong, "MsgPong", "Pong"},
+	{MsgPeerConnected, "MsgPeerConnected", "Peer connected"},
+	{MsgPeerDisconnected, "MsgPeerDisconnected", "Peer disconnected"},
+	{MsgLatency, "MsgLatency", "Latency"},
+	{MsgConnect, "MsgConnect", "Connect"},
+	{MsgAccept, "MsgAccept", "Accept"},
+	{MsgProbe, "MsgProbe", "Path MTU probe"},
+	{MsgProbeAck, "MsgProbeAck", "Path MTU probe acknowledgement"},
+}
@@ -0,0 +1,46 @@
+package network
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+func TestTrailer(t *testing.T) {
+	b := sealed(0, 2, PFCompressed, 1, 2, MsgData, 'h', 'i')
+
+	if v, ok := Unseal(b); !ok || v != ProtocolVersion {
+		t.Fatalf("unseal: version %d, %v", v, ok)
+	}
+
+	// Any single bit error is caught.
+	for i := range b {
+		for bit := 0; bit < 8; bit++ {
+			b[i] ^= 1 << bit
+			if _, ok := Unseal(b); ok {
+				t.Fatalf("Flipping bit %d of byte %d went unnoticed", bit, i)
+			}
+			b[i] ^= 1 << bit
+		}
+	}
+
+	// The checksum is not a plain CRC-32C, so other protocols using one
+	// are not mistaken for ours.
+	n := len(b) - 4
+	binary.BigEndian.PutUint32(b[n:], crc32.Checksum(b[:n], crcTable))
+	if _, ok := Unseal(b); ok {
+		t.Fatalf("A plain CRC-32C was accepted")
+	}
+
+	if _, ok := Unseal(b[:TrailerSize-1]); ok {
+		t.Fatalf("A truncated trailer was accepted")
+	}
+}
+
+// Seals a datagram as a peer of another protocol version would.
+func sealVersion(b []uint8, version uint8) []uint8 {
+	n := len(b) - TrailerSize
+	b[n] = version
+	binary.BigEndian.PutUint32(b[n+1:], crc32.Update(crcSeed, crcTable, b[:n+1]))
+	return b
+}
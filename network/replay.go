@@ -0,0 +1,162 @@
+package network
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Transport which plays back the inbound datagrams of a capture, so a
+// recorded session can be fed into a Peer again through Peer.Serve. This is
+// useful to reproduce bugs from a capture of production traffic.
+//
+// The local address is the one of the first datagram in the capture. Datagrams
+// the peer writes are discarded. Once the capture runs out, Done is closed and
+// ReadFrom blocks until the transport is closed.
+type ReplayTransport struct {
+	reader CaptureReader
+	clock  Clock
+	local  net.Addr
+	next   *Capture  // The first capture, read by NewReplayTransport.
+	origin time.Time // Time of the first capture.
+	start  time.Time // Time on our clock at which the replay started.
+	err    error     // The error which ended the replay, if not io.EOF.
+	lock   sync.Mutex
+	done   chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Creates a transport which replays the captures read from r. With a clock,
+// datagrams are delivered with the same spacing as they were captured.
+// Without one, they are delivered as fast as the peer reads them.
+func NewReplayTransport(r CaptureReader, c Clock) (*ReplayTransport, error) {
+	first, err := r.ReadCapture()
+	if err == io.EOF {
+		err = ErrInvalidCapture
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	rt := new(ReplayTransport)
+	rt.reader = r
+	rt.clock = c
+	rt.local = first.Local
+	rt.next = first
+	rt.origin = first.Time
+	rt.done = make(chan struct{})
+	rt.closed = make(chan struct{})
+	return rt, nil
+}
+
+// Returns a channel which is closed once every inbound datagram of the
+// capture has been read. Unless the peer uses several workers, they have
+// all been processed by then.
+func (this *ReplayTransport) Done() <-chan struct{} {
+	return this.done
+}
+
+// Returns the error which ended the replay early, if any. Reaching the end
+// of the capture is not an error.
+func (this *ReplayTransport) Err() error {
+	select {
+	case <-this.done:
+		return this.err
+	default:
+		return nil
+	}
+}
+
+func (this *ReplayTransport) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	select {
+	case <-this.done:
+		<-this.closed // Nothing left to play.
+		return 0, nil, net.ErrClosed
+	default:
+	}
+
+	for {
+		c := this.next
+		this.next = nil
+
+		if c == nil {
+			if c, err = this.reader.ReadCapture(); err != nil {
+				if err != io.EOF {
+					this.err = err
+				}
+				close(this.done)
+
+				<-this.closed
+				return 0, nil, net.ErrClosed
+			}
+		}
+
+		if !c.Inbound {
+			continue
+		}
+
+		if this.clock != nil && !this.wait(c.Time.Sub(this.origin)) {
+			return 0, nil, net.ErrClosed
+		}
+
+		// Just like UDP, excess data is discarded.
+		n = copy(b, c.Data)
+		return n, c.Remote, nil
+	}
+}
+
+// Waits until the given time has passed since the start of the replay.
+// Returns false if the transport was closed in the meantime.
+func (this *ReplayTransport) wait(at time.Duration) bool {
+	if this.start.IsZero() {
+		this.start = this.clock.Now()
+	}
+
+	if d := at - this.clock.Now().Sub(this.start); d > 0 {
+		ready := make(chan struct{})
+		this.clock.AfterFunc(d, func() { close(ready) })
+
+		select {
+		case <-ready:
+		case <-this.closed:
+			return false
+		}
+	}
+
+	select {
+	case <-this.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// Discards the datagram.
+func (this *ReplayTransport) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-this.closed:
+		return 0, net.ErrClosed
+	default:
+		return len(b), nil
+	}
+}
+
+// Stops the replay. Blocked ReadFrom calls return net.ErrClosed.
+func (this *ReplayTransport) Close() (err error) {
+	err = net.ErrClosed
+	this.once.Do(func() {
+		close(this.closed)
+		err = nil
+	})
+	return
+}
+
+func (this *ReplayTransport) LocalAddr() net.Addr {
+	return this.local
+}
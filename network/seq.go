@@ -0,0 +1,36 @@
+package network
+
+// A packet sequence number. The counter is 16 bits wide, so it wraps around
+// after 65535. Sequence numbers are therefore compared as serial numbers
+// (RFC 1982): s comes after a if it is less than half the number space ahead
+// of it. Two numbers exactly half the space apart are not ordered by Less.
+// Diff and Extend take the larger one to be the older in that case.
+type Seq uint16
+
+// Half the sequence number space. RFC 1982 calls it 2^(SERIAL_BITS - 1).
+const seqHalf = 1 << 15
+
+// Returns whether this comes before s.
+func (this Seq) Less(s Seq) bool {
+	return this != s && s-this < seqHalf
+}
+
+// Returns the signed distance from s to this. It is positive if this comes
+// after s, and lies in [-32768, 32767].
+func (this Seq) Diff(s Seq) int {
+	return int(int16(this - s))
+}
+
+// Extends this to 64 bits. Returns the number closest to ref which has this
+// as its lower 16 bits, where ref is an extended sequence number seen
+// before. Feeding each received number back in as the next ref keeps count
+// of the times the counter wrapped.
+func (this Seq) Extend(ref int64) int64 {
+	return ref + int64(this.Diff(Seq(ref)))
+}
+
+// Writes the sequence number to b, big endian.
+func (this Seq) put(b []uint8) {
+	b[0] = uint8(this >> 8)
+	b[1] = uint8(this)
+}
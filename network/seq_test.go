@@ -0,0 +1,177 @@
+package network
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestSeqCompare(t *testing.T) {
+	// Every number, against the numbers at the edges of its half of the
+	// space and right around it.
+	for i := 0; i < 1<<16; i++ {
+		a := Seq(i)
+
+		for _, d := range []int{1, 2, 100, seqHalf - 2, seqHalf - 1} {
+			b := a + Seq(d)
+			if !a.Less(b) || b.Less(a) {
+				t.Fatalf("Expected %d before %d", a, b)
+			}
+			if b.Diff(a) != d || a.Diff(b) != -d {
+				t.Fatalf("Distance between %d and %d: %d and %d, expected %d", a, b, b.Diff(a), a.Diff(b), d)
+			}
+		}
+
+		// Half the space apart is undefined in RFC 1982.
+		if b := a + seqHalf; a.Less(b) || b.Less(a) {
+			t.Fatalf("Expected %d and %d to be unordered", a, b)
+		}
+
+		if a.Less(a) || a.Diff(a) != 0 {
+			t.Fatalf("%d compares unequal to itself", a)
+		}
+	}
+
+	// All distances around the wrap.
+	for _, a := range []Seq{65535, 0} {
+		for d := 1 - seqHalf; d < seqHalf; d++ {
+			b := a + Seq(d)
+			if b.Diff(a) != d || (d > 0) != a.Less(b) || (d < 0) != b.Less(a) {
+				t.Fatalf("%d and %d at distance %d", a, b, d)
+			}
+		}
+	}
+}
+
+func TestSeqExtend(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	// Count up through a few wraps. Each number arrives shuffled among its
+	// neighbours, up to half the space late or early.
+	var highest int64 = 65530
+	for n := highest; n < 4<<16; n += int64(r.Intn(1000)) {
+		for _, d := range []int64{0, 1, -1, seqHalf - 1, -seqHalf, 1 - seqHalf} {
+			want := n + d
+			if got := Seq(want).Extend(n); got != want {
+				t.Fatalf("Seq(%d).Extend(%d) = %d, want %d", Seq(want), n, got, want)
+			}
+		}
+
+		// The next number is always ahead of the highest one.
+		if got := Seq(n).Extend(highest); got != n {
+			t.Fatalf("Seq(%d).Extend(%d) = %d, want %d", Seq(n), highest, got, n)
+		}
+		highest = n
+	}
+}
+
+func TestSeqWrap(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	a, _ := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, nil)
+	b, rec := newMemoryPeer(t, n, clock, "10.0.0.2:7000", 2, nil, nil)
+	defer a.Close()
+	defer b.Close()
+
+	// The second of three fragments wraps the counter.
+	a.Sequence = 65534
+	a.SendTo(b.Addr, make([]uint8, 2*PacketSize))
+	a.SendTo(b.Addr, []uint8("after"))
+	n.Flush()
+
+	msgs := rec.take(MsgData)
+	if len(msgs) != 2 || len(msgs[0].data.([]uint8)) != 2*PacketSize || string(msgs[1].data.([]uint8)) != "after" {
+		t.Fatalf("Expected both messages across the wrap, got %v", msgs)
+	}
+
+	client := b.GetClient(a.Id)
+	if client.RemoteSequence != 1 {
+		t.Fatalf("Expected remote sequence 1, got %d", client.RemoteSequence)
+	}
+
+	if st := client.Stats(); st.LossIn != 0 || st.OutOfOrder != 0 || st.PacketsReceived != 4 {
+		t.Fatalf("Unexpected stats across the wrap: %+v", st)
+	}
+}
+
+func TestSeqStaleFragment(t *testing.T) {
+	n := NewMemoryNetwork()
+	p, rec := newMemoryPeer(t, n, NewManualClock(time.Unix(1e9, 0)), "10.0.0.1:7000", 1, nil, &peerConfig{ErrorHandler: ignoreErrors})
+	defer p.Close()
+
+	from, _ := NewPeer(p.Addr, []uint8{0, 2})
+
+	fragment := func(seq Seq, cur, total uint8) Packet {
+		packet := make(Packet, 16+7+4)
+		putAddrIP(packet, p.Addr)
+		packet[17] = 2
+		packet[18] = PFFragmented
+		seq.put(packet[16+offSequence:])
+		packet[21], packet[22] = cur, total
+		packet[23] = MsgData
+		return packet
+	}
+
+	// A message across the wrap, interrupted by a fragment of an older one.
+	p.process(p.Addr, fragment(65535, 0, 2), 0)
+	p.process(p.Addr, fragment(65533, 1, 2), 0)
+	p.process(p.Addr, fragment(0, 1, 2), 0)
+
+	st := p.GetClient(from.Id).Stats()
+	if st.Dropped != 1 || st.ReassemblyFailures != 0 {
+		t.Fatalf("Expected the stale fragment to be dropped, got %+v", st)
+	}
+
+	if msgs := rec.take(MsgData); len(msgs) != 1 || len(msgs[0].data.([]byte)) != 7 {
+		t.Fatalf("Expected the message to be reassembled, got %v", msgs)
+	}
+}
+
+func TestSeqDuplicate(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	cfg, sim := simulated(clock)
+	a, arec := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, cfg)
+	b, rec := newMemoryPeer(t, n, clock, "10.0.0.2:7000", 2, nil, nil)
+	defer a.Close()
+	defer b.Close()
+
+	// Every datagram arrives twice: a message and one of three fragments.
+	sim.SetOutbound(Conditions{Duplicate: 1})
+	a.SendTo(b.Addr, []uint8("once"))
+	a.SendTo(b.Addr, make([]uint8, 2*PacketSize))
+	n.Flush()
+
+	if msgs := rec.take(MsgData); len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+
+	client := b.GetClient(a.Id)
+	if st := client.Stats(); st.Duplicates != 4 || st.PacketsReceived != 8 {
+		t.Fatalf("Expected 4 duplicates of 8 packets, got %+v", st)
+	}
+
+	// Once a knows b, SendTo goes out with the sequence of b's peer, which
+	// carries on from the packets above.
+	sim.SetOutbound(Conditions{})
+	client.Send([]uint8("hi"))
+	n.Flush()
+
+	if msgs := arec.take(MsgData); len(msgs) != 1 {
+		t.Fatalf("Expected a to receive 1 message, got %d", len(msgs))
+	}
+
+	a.SendTo(b.Addr, []uint8("again"))
+	a.GetClient(b.Id).Send([]uint8("and again"))
+	n.Flush()
+
+	if msgs := rec.take(MsgData); len(msgs) != 2 {
+		t.Fatalf("Expected 2 more messages, got %d", len(msgs))
+	}
+
+	if st := client.Stats(); st.Duplicates != 4 {
+		t.Fatalf("Expected no more duplicates, got %d", st.Duplicates)
+	}
+}
@@ -0,0 +1,346 @@
+package network
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Describes the quality of a simulated link in one direction. The zero value
+// is a perfect link: nothing is lost, delayed, duplicated or reordered.
+type Conditions struct {
+	Loss         float64        // Probability [0-1] that a datagram is lost. Ignored when Burst is enabled.
+	Burst        GilbertElliott // Bursty loss model. Enabled when Burst.P > 0.
+	Delay        time.Duration  // Fixed delay added to every datagram.
+	Jitter       time.Duration  // Maximum random delay added on top of Delay.
+	Duplicate    float64        // Probability [0-1] that a datagram is delivered twice.
+	Reorder      float64        // Probability [0-1] that a datagram is held back by ReorderDelay, so later ones overtake it.
+	ReorderDelay time.Duration  // Extra delay for reordered datagrams. Defaults to 10ms.
+	Bandwidth    int            // Link capacity in bytes per second. 0 means unlimited.
+	QueueSize    int            // Bytes that may wait for a busy link before datagrams are dropped. 0 means unlimited.
+	MTU          int            // Largest datagram the link carries, without IP and UDP headers. Larger ones are lost. 0 means unlimited.
+}
+
+// Parameters of the Gilbert-Elliott loss model. The link is in either a good
+// or a bad state, and switches between them with the given probabilities for
+// every datagram. Each state has its own loss rate, which produces the bursts
+// of consecutive losses typical for congested or wireless links.
+type GilbertElliott struct {
+	P        float64 // Probability of going from the good to the bad state.
+	R        float64 // Probability of going from the bad back to the good state.
+	LossGood float64 // Loss probability while in the good state. Usually 0.
+	LossBad  float64 // Loss probability while in the bad state. Usually close to 1.
+}
+
+// A Transport which wraps another one and subjects the traffic passing
+// through it to the configured link conditions. Inbound and outbound traffic
+// are configured separately, and the conditions can be changed at any time.
+//
+// Delays are measured with the given clock. Outbound traffic is impaired on
+// the calling goroutine, so with a ManualClock and a MemoryNetwork everything
+// stays deterministic. Impairing inbound traffic requires a goroutine which
+// reads ahead from the wrapped transport; it is started the first time
+// SetInbound is called, or when a ReadFrom which was already waiting on the
+// wrapped transport returns. In lockstep tests, prefer impairing the outbound
+// side of the sending peer instead.
+type SimulatedTransport struct {
+	transport Transport
+	clock     Clock
+	lock      sync.Mutex
+	cond      *sync.Cond
+	rand      *rand.Rand
+	in        link
+	out       link
+	pumping   bool      // Inbound traffic goes through pump() and the ready queue.
+	reading   bool      // A ReadFrom waits on the wrapped transport itself. See SetInbound.
+	ready     []transit // Inbound datagrams which made it through the simulated link.
+	err       error     // Read error reported by pump().
+	closed    bool
+}
+
+// State of one direction of the simulated link.
+type link struct {
+	cond      Conditions
+	bad       bool      // Current Gilbert-Elliott state.
+	busyUntil time.Time // The time the link finishes sending what it has queued.
+}
+
+// Wraps t in a simulated link. A nil clock means SystemClock.
+func NewSimulatedTransport(t Transport, c Clock) *SimulatedTransport {
+	if c == nil {
+		c = SystemClock
+	}
+
+	s := new(SimulatedTransport)
+	s.transport = t
+	s.clock = c
+	s.cond = sync.NewCond(&s.lock)
+	s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	return s
+}
+
+// Seeds the random number generator, for reproducible runs.
+func (this *SimulatedTransport) Seed(seed int64) {
+	this.lock.Lock()
+	this.rand.Seed(seed)
+	this.lock.Unlock()
+}
+
+// Sets the conditions for traffic we send.
+func (this *SimulatedTransport) SetOutbound(c Conditions) {
+	this.lock.Lock()
+	this.out.cond = c
+	this.lock.Unlock()
+}
+
+// Sets the conditions for traffic we receive.
+func (this *SimulatedTransport) SetInbound(c Conditions) {
+	this.lock.Lock()
+	this.in.cond = c
+
+	if !this.pumping && !this.closed {
+		this.pumping = true
+
+		// Two readers would race for the datagrams, so a ReadFrom still
+		// waiting on the wrapped transport starts the pump once it returns.
+		if !this.reading {
+			go this.pump()
+		}
+	}
+	this.lock.Unlock()
+}
+
+// Returns the conditions for traffic we send.
+func (this *SimulatedTransport) Outbound() Conditions {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.out.cond
+}
+
+// Returns the conditions for traffic we receive.
+func (this *SimulatedTransport) Inbound() Conditions {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.in.cond
+}
+
+func (this *SimulatedTransport) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	this.lock.Lock()
+
+	if !this.pumping {
+		this.reading = true
+		this.lock.Unlock()
+
+		n, addr, err = this.transport.ReadFrom(b)
+
+		this.lock.Lock()
+		this.reading = false
+		pump := this.pumping
+		this.lock.Unlock()
+
+		if !pump {
+			return
+		}
+
+		// SetInbound was called in the meantime. What we read must pass the
+		// inbound side of the link as well.
+		if err == nil {
+			this.arrive(addr, b[:n])
+		}
+		go this.pump()
+
+		if err != nil {
+			return
+		}
+		this.lock.Lock()
+	}
+
+	defer this.lock.Unlock()
+
+	for len(this.ready) == 0 && this.err == nil && !this.closed {
+		this.cond.Wait()
+	}
+
+	switch {
+	case len(this.ready) > 0:
+		d := this.ready[0]
+		this.ready = this.ready[1:]
+		return copy(b, d.data), d.from, nil
+	case this.err != nil:
+		err, this.err = this.err, nil
+		return 0, nil, err
+	}
+	return 0, nil, net.ErrClosed
+}
+
+func (this *SimulatedTransport) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	data := append([]byte(nil), b...)
+
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		return 0, net.ErrClosed
+	}
+
+	delays := this.out.impair(this.rand, this.clock.Now(), len(data))
+	this.lock.Unlock()
+
+	for _, delay := range delays {
+		if delay <= 0 {
+			if _, err = this.transport.WriteTo(data, addr); err != nil {
+				return
+			}
+			continue
+		}
+
+		this.clock.AfterFunc(delay, func() {
+			this.lock.Lock()
+			closed := this.closed
+			this.lock.Unlock()
+
+			if !closed {
+				this.transport.WriteTo(data, addr)
+			}
+		})
+	}
+
+	// Lost datagrams are not an error. The sender never knows.
+	return len(b), nil
+}
+
+func (this *SimulatedTransport) Close() error {
+	this.lock.Lock()
+	this.closed = true
+	this.cond.Broadcast()
+	this.lock.Unlock()
+
+	return this.transport.Close()
+}
+
+func (this *SimulatedTransport) LocalAddr() net.Addr {
+	return this.transport.LocalAddr()
+}
+
+// Reads from the wrapped transport and moves the datagrams through the
+// inbound side of the simulated link.
+func (this *SimulatedTransport) pump() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, addr, err := this.transport.ReadFrom(buf)
+
+		this.lock.Lock()
+
+		if err != nil {
+			if this.closed || errors.Is(err, net.ErrClosed) {
+				this.closed = true
+				this.cond.Broadcast()
+				this.lock.Unlock()
+				return
+			}
+
+			this.err = err
+			this.cond.Broadcast()
+			this.lock.Unlock()
+			continue
+		}
+
+		this.lock.Unlock()
+		this.arrive(addr, buf[:n])
+	}
+}
+
+// Moves a datagram we received through the inbound side of the simulated link.
+func (this *SimulatedTransport) arrive(from net.Addr, b []byte) {
+	d := transit{from: from, data: append([]byte(nil), b...)}
+
+	this.lock.Lock()
+	delays := this.in.impair(this.rand, this.clock.Now(), len(b))
+	this.lock.Unlock()
+
+	for _, delay := range delays {
+		if delay <= 0 {
+			this.deliver(d)
+		} else {
+			this.clock.AfterFunc(delay, func() { this.deliver(d) })
+		}
+	}
+}
+
+// Places an inbound datagram in the ready queue.
+func (this *SimulatedTransport) deliver(d transit) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if !this.closed {
+		this.ready = append(this.ready, d)
+		this.cond.Broadcast()
+	}
+}
+
+// Decides the fate of a datagram of the given size. It returns one delay for
+// every copy that should be delivered: none if it is lost, two if it is
+// duplicated. Called with the transport lock held.
+func (this *link) impair(r *rand.Rand, now time.Time, size int) []time.Duration {
+	c := &this.cond
+
+	if c.MTU > 0 && size > c.MTU {
+		return nil // Too large, and not fragmented.
+	}
+
+	if c.Burst.P > 0 {
+		if this.bad {
+			this.bad = r.Float64() >= c.Burst.R
+		} else {
+			this.bad = r.Float64() < c.Burst.P
+		}
+
+		loss := c.Burst.LossGood
+		if this.bad {
+			loss = c.Burst.LossBad
+		}
+
+		if r.Float64() < loss {
+			return nil
+		}
+	} else if r.Float64() < c.Loss {
+		return nil
+	}
+
+	var delay time.Duration
+
+	if c.Bandwidth > 0 {
+		start := now
+		if this.busyUntil.After(now) {
+			start = this.busyUntil
+		}
+
+		backlog := int(start.Sub(now) * time.Duration(c.Bandwidth) / time.Second)
+		if c.QueueSize > 0 && backlog+size > c.QueueSize {
+			return nil // Tail drop.
+		}
+
+		this.busyUntil = start.Add(time.Duration(size) * time.Second / time.Duration(c.Bandwidth))
+		delay = this.busyUntil.Sub(now)
+	}
+
+	delay += c.Delay
+	if c.Jitter > 0 {
+		delay += time.Duration(r.Int63n(int64(c.Jitter)))
+	}
+
+	if r.Float64() < c.Reorder {
+		if c.ReorderDelay > 0 {
+			delay += c.ReorderDelay
+		} else {
+			delay += 10 * time.Millisecond
+		}
+	}
+
+	if r.Float64() < c.Duplicate {
+		return []time.Duration{delay, delay}
+	}
+	return []time.Duration{delay}
+}
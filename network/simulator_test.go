@@ -0,0 +1,166 @@
+package network
+
+import "testing"
+import "time"
+
+// Sets up a simulated sender and a plain receiver on a memory network. The
+// receiver is drained by a goroutine, so MemoryNetwork.Flush can complete.
+func newSimulatedLink(t *testing.T) (*ManualClock, *MemoryNetwork, *SimulatedTransport, *MemoryTransport) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	a, err := n.Listen("10.0.0.1:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := n.Listen("10.0.0.2:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := b.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	sim := NewSimulatedTransport(a, clock)
+	sim.Seed(1)
+	return clock, n, sim, b
+}
+
+// Returns settings for newMemoryPeer under which the peer's traffic passes
+// through the returned simulated link.
+func simulated(c Clock) (*peerConfig, *SimulatedTransport) {
+	sim := NewSimulatedTransport(nil, c)
+	return &peerConfig{Wrap: func(tr Transport) Transport {
+		sim.transport = tr
+		return sim
+	}}, sim
+}
+
+func TestSimulatedDelay(t *testing.T) {
+	clock, n, sim, b := newSimulatedLink(t)
+	defer sim.Close()
+	defer b.Close()
+
+	sim.SetOutbound(Conditions{Delay: 100 * time.Millisecond})
+	sim.WriteTo(make([]byte, 10), b.LocalAddr())
+
+	if c := n.Flush(); c != 0 {
+		t.Fatalf("Datagram arrived %d times before its delay passed", c)
+	}
+
+	clock.Advance(99 * time.Millisecond)
+	if c := n.Flush(); c != 0 {
+		t.Fatalf("Datagram arrived %d times before its delay passed", c)
+	}
+
+	clock.Advance(time.Millisecond)
+	if c := n.Flush(); c != 1 {
+		t.Fatalf("Expected 1 datagram after the delay, got %d", c)
+	}
+}
+
+func TestSimulatedLossAndDuplication(t *testing.T) {
+	_, n, sim, b := newSimulatedLink(t)
+	defer sim.Close()
+	defer b.Close()
+
+	sim.SetOutbound(Conditions{Loss: 1})
+	sim.WriteTo(make([]byte, 10), b.LocalAddr())
+	if c := n.Flush(); c != 0 {
+		t.Fatalf("Expected total loss, got %d datagrams", c)
+	}
+
+	// Permanently stuck in the bad state.
+	sim.SetOutbound(Conditions{Burst: GilbertElliott{P: 1, R: 0, LossBad: 1}})
+	for i := 0; i < 10; i++ {
+		sim.WriteTo(make([]byte, 10), b.LocalAddr())
+	}
+	if c := n.Flush(); c != 0 {
+		t.Fatalf("Expected a loss burst, got %d datagrams", c)
+	}
+
+	sim.SetOutbound(Conditions{Duplicate: 1})
+	sim.WriteTo(make([]byte, 10), b.LocalAddr())
+	if c := n.Flush(); c != 2 {
+		t.Fatalf("Expected a duplicate, got %d datagrams", c)
+	}
+}
+
+func TestSimulatedBandwidth(t *testing.T) {
+	clock, n, sim, b := newSimulatedLink(t)
+	defer sim.Close()
+	defer b.Close()
+
+	// 1000 bytes/s with room for a single queued datagram.
+	sim.SetOutbound(Conditions{Bandwidth: 1000, QueueSize: 200})
+	for i := 0; i < 3; i++ {
+		sim.WriteTo(make([]byte, 100), b.LocalAddr())
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	if c := n.Flush(); c != 1 {
+		t.Fatalf("Expected 1 datagram after 100ms, got %d", c)
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	if c := n.Flush(); c != 1 {
+		t.Fatalf("Expected 1 datagram after 200ms, got %d", c)
+	}
+
+	clock.Advance(time.Second)
+	if c := n.Flush(); c != 0 {
+		t.Fatalf("Third datagram should have been dropped, got %d", c)
+	}
+}
+
+func TestSimulatedInboundLate(t *testing.T) {
+	clock, n, sim, b := newSimulatedLink(t)
+	defer sim.Close()
+	defer b.Close()
+
+	got := make(chan int, 8)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, _, err := sim.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			got <- n
+		}
+	}()
+
+	// The reader is waiting on the wrapped transport already, as a serving
+	// peer's would be.
+	time.Sleep(10 * time.Millisecond)
+	sim.SetInbound(Conditions{Delay: 100 * time.Millisecond})
+
+	for i := 1; i <= 2; i++ {
+		b.WriteTo(make([]byte, i), sim.LocalAddr())
+		n.Flush()
+
+		select {
+		case c := <-got:
+			t.Fatalf("Datagram of %d bytes skipped the inbound delay", c)
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		clock.Advance(100 * time.Millisecond)
+
+		select {
+		case c := <-got:
+			if c != i {
+				t.Fatalf("Expected a datagram of %d bytes, got %d", i, c)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Datagram %d did not arrive after the delay", i)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package network
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// A snapshot of the statistics we keep for the connection with a peer. See
+// Peer.Stats. Round trip times are measured with the ping requests a
+// listening peer sends to its clients.
+//
+// The statistics of a listener itself hold the totals over all its peers:
+// traffic, dropped packets, reassembly failures and the RTT histogram. Its
+// RTT, loss and sequence related fields are not used.
+type Stats struct {
+	RTT    time.Duration // Smoothed round trip time (SRTT, RFC 6298).
+	RTTVar time.Duration // Round trip time variation (RTTVAR, RFC 6298).
+	Jitter time.Duration // Smoothed difference between consecutive round trip times (RFC 3550 style).
+
+	PacketsSent     uint64 // Packets we sent to the peer.
+	PacketsReceived uint64 // Packets we received from the peer.
+	BytesSent       uint64 // Bytes we sent to the peer, including our packet headers.
+	BytesReceived   uint64 // Bytes we received from the peer, including our packet headers.
+
+	LossIn             float64 // Fraction [0-1] of the last 256 packets sent by the peer, which did not arrive.
+	LossOut            float64 // Fraction [0-1] of the packets we sent, which did not arrive. Reported by the peer.
+	ReorderDepth       int     // Largest number of packets by which one of the last 256 was overtaken.
+	Retransmits        uint64  // Packets which had to be sent again. Currently only Dial handshakes are repeated.
+	Duplicates         uint64  // Packets received more than once, or too old to tell. Both are dropped.
+	OutOfOrder         uint64  // Packets which arrived after one with a higher sequence number.
+	ReassemblyFailures uint64  // Fragmented messages which were abandoned because fragments went missing or timed out.
+	Dropped            uint64  // Invalid packets which were discarded.
+	PathMTU            int     // Largest datagram we send to the peer, without IP and UDP headers. See Config.PathMTU.
+	SendRate           int     // Bytes per second we may send to the peer. 0 means unlimited. See Peer.SendRate.
+
+	RTTHistogram [len(RTTBuckets) + 1]uint64 // Number of round trip time samples <= each of RTTBuckets. The last one counts all samples.
+	RTTSum       time.Duration               // Sum of all round trip time samples.
+}
+
+// Upper bounds of the buckets of Stats.RTTHistogram.
+var RTTBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Number of received sequence numbers we remember per peer. Loss and
+// reordering are measured over this window.
+const seqWindow = 256
+
+// The statistics kept for a peer. They are updated from the sending and
+// receiving goroutines and read by Peer.Stats, so they have their own lock.
+type peerStats struct {
+	lock     sync.Mutex
+	stats    Stats
+	sampled  bool          // Set once we have a round trip time sample.
+	lastrtt  time.Duration // The previous round trip time sample. Used for jitter.
+	receiver bool          // Set once we received a packet. The fields below are valid.
+	first    int64         // Extended sequence number of the first packet we received.
+	highest  int64         // Highest extended sequence number we received.
+
+	// The sequence numbers in the window (highest-seqWindow, highest] we
+	// received, and by how many packets they were overtaken. Both are
+	// indexed by sequence number modulo seqWindow.
+	history [seqWindow / 64]uint64
+	depth   [seqWindow]uint16
+}
+
+// Returns a snapshot of the statistics for the connection with this peer. It
+// is safe to call this at any time, from any goroutine.
+func (this *Peer) Stats() Stats {
+	s := &this.stats
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := s.stats
+	stats.LossIn = s.lossIn()
+	stats.PathMTU = this.pmtu.get()
+	stats.SendRate = this.cc.rate()
+
+	for _, d := range s.depth {
+		if int(d) > stats.ReorderDepth {
+			stats.ReorderDepth = int(d)
+		}
+	}
+	return stats
+}
+
+// Returns the fraction of the packets in the window which did not arrive.
+// Called with the lock held.
+func (this *peerStats) lossIn() float64 {
+	if !this.receiver {
+		return 0
+	}
+
+	span := this.highest - this.first + 1
+	if span > seqWindow {
+		span = seqWindow
+	}
+
+	var received int64
+	for _, w := range this.history {
+		received += int64(bits.OnesCount64(w))
+	}
+	return float64(span-received) / float64(span)
+}
+
+// Encodes our inbound loss as a 16 bit fraction, for the peer to read in our
+// ping and pong messages.
+func (this *peerStats) lossReport() uint16 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return uint16(this.lossIn()*65535 + 0.5)
+}
+
+// Records the loss the peer reported for the packets we sent it.
+func (this *peerStats) reported(loss uint16) {
+	this.lock.Lock()
+	this.stats.LossOut = float64(loss) / 65535
+	this.lock.Unlock()
+}
+
+// Records n packets with a total of size bytes, sent to the peer.
+func (this *peerStats) sent(n, size int) {
+	this.lock.Lock()
+	this.stats.PacketsSent += uint64(n)
+	this.stats.BytesSent += uint64(size)
+	this.lock.Unlock()
+}
+
+// Records a packet of the given size, received by a listener from any peer.
+func (this *peerStats) total(size int) {
+	this.lock.Lock()
+	this.stats.PacketsReceived++
+	this.stats.BytesReceived += uint64(size)
+	this.lock.Unlock()
+}
+
+// Records a packet of the given size, received from the peer. The sequence
+// number is extended to 64 bits around the highest one so far (see
+// Seq.Extend), so it survives the wrapping of the counter.
+//
+// Returns false for a duplicate of a packet in the window, and for packets
+// older than the window, which can not be told from a replay. Those are
+// counted as duplicates, and should be dropped. A peer which restarted its
+// sequence gets through again once it has timed out and been forgotten.
+func (this *peerStats) received(seq Seq, size int) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.stats.PacketsReceived++
+	this.stats.BytesReceived += uint64(size)
+
+	if !this.receiver {
+		this.receiver = true
+		this.first = int64(seq)
+		this.highest = int64(seq)
+		this.mark(this.highest, 0)
+		return true
+	}
+
+	d := seq.Extend(this.highest) - this.highest
+
+	switch {
+	case d > 0:
+		// Slide the window forward. Sequence numbers we skipped are
+		// missing until they show up.
+		for i := int64(1); i <= d && i <= seqWindow; i++ {
+			this.unmark(this.highest + i)
+		}
+		this.highest += d
+		this.mark(this.highest, 0)
+
+	case -d >= seqWindow, this.marked(this.highest + d):
+		this.stats.Duplicates++
+		return false
+
+	default:
+		this.stats.OutOfOrder++
+		this.mark(this.highest+d, uint16(-d))
+
+		if this.highest+d < this.first {
+			this.first = this.highest + d // Overtaken by the first packet we saw.
+		}
+	}
+	return true
+}
+
+func (this *peerStats) mark(seq int64, depth uint16) {
+	i := seq & (seqWindow - 1)
+	this.history[i/64] |= 1 << uint(i%64)
+	this.depth[i] = depth
+}
+
+func (this *peerStats) unmark(seq int64) {
+	i := seq & (seqWindow - 1)
+	this.history[i/64] &^= 1 << uint(i%64)
+	this.depth[i] = 0
+}
+
+func (this *peerStats) marked(seq int64) bool {
+	i := seq & (seqWindow - 1)
+	return this.history[i/64]&(1<<uint(i%64)) != 0
+}
+
+// Records a round trip time sample. SRTT and RTTVAR are updated as
+// described in RFC 6298, section 2.
+func (this *peerStats) rtt(r time.Duration) {
+	if r < 0 {
+		r = 0
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.histogram(r)
+	s := &this.stats
+
+	if !this.sampled {
+		this.sampled = true
+		s.RTT = r
+		s.RTTVar = r / 2
+		this.lastrtt = r
+		return
+	}
+
+	delta := s.RTT - r
+	if delta < 0 {
+		delta = -delta
+	}
+
+	s.RTTVar = (3*s.RTTVar + delta) / 4
+	s.RTT = (7*s.RTT + r) / 8
+
+	d := r - this.lastrtt
+	if d < 0 {
+		d = -d
+	}
+
+	s.Jitter += (d - s.Jitter) / 16
+	this.lastrtt = r
+}
+
+// Adds a round trip time sample to the histogram only. Used for the totals of
+// a listener.
+func (this *peerStats) observe(r time.Duration) {
+	this.lock.Lock()
+	this.histogram(r)
+	this.lock.Unlock()
+}
+
+// Called with the lock held.
+func (this *peerStats) histogram(r time.Duration) {
+	for i, b := range RTTBuckets {
+		if r <= b {
+			this.stats.RTTHistogram[i]++
+		}
+	}
+	this.stats.RTTHistogram[len(RTTBuckets)]++
+	this.stats.RTTSum += r
+}
+
+// Records an invalid packet which was discarded.
+func (this *peerStats) dropped() {
+	this.lock.Lock()
+	this.stats.Dropped++
+	this.lock.Unlock()
+}
+
+// Records a fragmented message which could not be reassembled.
+func (this *peerStats) reassemblyFailed() {
+	this.lock.Lock()
+	this.stats.ReassemblyFailures++
+	this.lock.Unlock()
+}
+
+// Records n packets which had to be sent again.
+func (this *peerStats) retransmitted(n int) {
+	this.lock.Lock()
+	this.stats.Retransmits += uint64(n)
+	this.lock.Unlock()
+}
@@ -0,0 +1,334 @@
+package network
+
+import "testing"
+import "time"
+
+func TestStatsRTT(t *testing.T) {
+	var s peerStats
+
+	s.rtt(100 * time.Millisecond)
+	if st := s.stats; st.RTT != 100*time.Millisecond || st.RTTVar != 50*time.Millisecond {
+		t.Fatalf("First sample: RTT %v, RTTVar %v", st.RTT, st.RTTVar)
+	}
+
+	s.rtt(200 * time.Millisecond)
+	st := s.stats
+
+	if st.RTT != 112500*time.Microsecond {
+		t.Fatalf("Expected RTT 112.5ms, got %v", st.RTT)
+	}
+
+	if st.RTTVar != 62500*time.Microsecond {
+		t.Fatalf("Expected RTTVar 62.5ms, got %v", st.RTTVar)
+	}
+
+	if st.Jitter != 6250*time.Microsecond {
+		t.Fatalf("Expected jitter 6.25ms, got %v", st.Jitter)
+	}
+}
+
+func TestStatsSequence(t *testing.T) {
+	var p Peer
+
+	// Wraps around, loses 1, then receives it late, and a duplicate of 2.
+	for _, seq := range []Seq{65534, 65535, 0, 2} {
+		p.stats.received(seq, 10)
+	}
+
+	if st := p.Stats(); st.LossIn != 0.2 {
+		t.Fatalf("Expected 20%% loss, got %v", st.LossIn)
+	}
+
+	p.stats.received(1, 10)
+	p.stats.received(2, 10)
+
+	st := p.Stats()
+	if st.LossIn != 0 {
+		t.Fatalf("Expected no loss, got %v", st.LossIn)
+	}
+
+	if st.OutOfOrder != 1 || st.Duplicates != 1 {
+		t.Fatalf("Expected 1 out of order and 1 duplicate, got %d and %d", st.OutOfOrder, st.Duplicates)
+	}
+
+	if st.PacketsReceived != 6 || st.BytesReceived != 60 {
+		t.Fatalf("Expected 6 packets of 60 bytes, got %d and %d", st.PacketsReceived, st.BytesReceived)
+	}
+}
+
+func TestStatsLatency(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	scfg, ssim := simulated(clock)
+	server, srec := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, scfg)
+	acfg, asim := simulated(clock)
+	a, _ := newMemoryPeer(t, n, clock, "10.0.0.2:7000", 2, nil, acfg)
+	defer server.Close()
+	defer a.Close()
+
+	// Both directions take 50ms, which is more than a uint16 of microseconds
+	// could hold for the round trip.
+	ssim.SetOutbound(Conditions{Delay: 50 * time.Millisecond})
+	asim.SetOutbound(Conditions{Delay: 50 * time.Millisecond})
+
+	a.SendTo(server.Addr, []byte("hello"))
+	clock.Advance(50 * time.Millisecond)
+	n.Flush()
+
+	// Ping goes out at 1s and arrives at 1.05s. The pong is back at 1.1s.
+	clock.Advance(950 * time.Millisecond)
+	n.Flush()
+	clock.Advance(50 * time.Millisecond)
+	n.Flush()
+	clock.Advance(50 * time.Millisecond)
+	n.Flush()
+
+	msgs := srec.take(MsgLatency)
+	if len(msgs) != 1 || msgs[0].data.(time.Duration) != 100*time.Millisecond {
+		t.Fatalf("Expected one latency report of 100ms, got %v", msgs)
+	}
+
+	st := server.GetClient(a.Id).Stats()
+	if st.RTT != 100*time.Millisecond {
+		t.Fatalf("Expected RTT 100ms, got %v", st.RTT)
+	}
+
+	if st.PacketsReceived != 2 || st.PacketsSent != 1 {
+		t.Fatalf("Expected 2 packets received and 1 sent, got %d and %d", st.PacketsReceived, st.PacketsSent)
+	}
+}
+
+func TestStatsReassemblyFailure(t *testing.T) {
+	n := NewMemoryNetwork()
+	p, rec := newMemoryPeer(t, n, NewManualClock(time.Unix(1e9, 0)), "10.0.0.1:7000", 1, nil, &peerConfig{ErrorHandler: ignoreErrors})
+	defer p.Close()
+
+	from, _ := NewPeer(p.Addr, []uint8{0, 2})
+
+	fragment := func(seq uint16, cur, total uint8) Packet {
+		packet := make(Packet, 16+7+4)
+		putAddrIP(packet, p.Addr)
+		packet[17] = 2
+		packet[18] = PFFragmented
+		packet[19], packet[20] = uint8(seq>>8), uint8(seq)
+		packet[21], packet[22] = cur, total
+		packet[23] = MsgData
+		return packet
+	}
+
+	// The second fragment of the first message never arrives.
+	p.process(p.Addr, fragment(10, 0, 2), 0)
+	p.process(p.Addr, fragment(12, 0, 2), 0)
+	p.process(p.Addr, fragment(13, 1, 2), 0)
+
+	if st := p.GetClient(from.Id).Stats(); st.ReassemblyFailures != 1 {
+		t.Fatalf("Expected 1 reassembly failure, got %d", st.ReassemblyFailures)
+	}
+
+	// Invalid packets count towards the peer and the listener's totals.
+	p.process(p.Addr, fragment(14, 2, 2), 0)
+
+	if st := p.GetClient(from.Id).Stats(); st.Dropped != 1 {
+		t.Fatalf("Expected 1 dropped packet, got %d", st.Dropped)
+	}
+
+	if st := p.Stats(); st.ReassemblyFailures != 1 || st.Dropped != 1 || st.PacketsReceived != 4 {
+		t.Fatalf("Unexpected listener totals: %+v", st)
+	}
+
+	if msgs := rec.take(MsgData); len(msgs) != 1 || len(msgs[0].data.([]byte)) != 7 {
+		t.Fatalf("Expected the second message to be reassembled, got %v", msgs)
+	}
+}
+
+func TestStatsReassemblyTimeout(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+	p, rec := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, nil)
+	defer p.Close()
+
+	from, _ := NewPeer(p.Addr, []uint8{0, 2})
+
+	packet := func(seq Seq, flags uint8, extra ...uint8) Packet {
+		packet := append(make(Packet, 16+5), extra...)
+		putAddrIP(packet, p.Addr)
+		packet[17] = 2
+		packet[18] = flags
+		seq.put(packet[16+offSequence:])
+		return packet
+	}
+
+	// The second fragment never arrives, and no other message follows. The
+	// peer keeps talking, so it does not time out.
+	start := clock.Now().UnixNano()
+	p.process(p.Addr, packet(10, PFFragmented, 0, 2, MsgData), start)
+
+	clock.Advance(3 * time.Second)
+	p.process(p.Addr, packet(11, 0, MsgData), clock.Now().UnixNano())
+
+	client := p.GetClient(from.Id)
+	if st := client.Stats(); st.ReassemblyFailures != 0 {
+		t.Fatalf("Expected no reassembly failure yet, got %d", st.ReassemblyFailures)
+	}
+
+	clock.Advance(3 * time.Second)
+
+	if st := client.Stats(); st.ReassemblyFailures != 1 {
+		t.Fatalf("Expected the message to time out, got %d reassembly failures", st.ReassemblyFailures)
+	}
+
+	client.fraglock.Lock()
+	cached := len(client.cache)
+	client.fraglock.Unlock()
+
+	if cached != 0 {
+		t.Fatalf("Expected the fragments to be released, %d are cached", cached)
+	}
+
+	if msgs := rec.take(MsgData); len(msgs) != 1 {
+		t.Fatalf("Expected only the unfragmented message, got %v", msgs)
+	}
+}
+
+func TestStatsWindow(t *testing.T) {
+	var p Peer
+
+	for _, seq := range []Seq{1, 2, 5, 6, 3} {
+		p.stats.received(seq, 10)
+	}
+
+	st := p.Stats()
+	if st.LossIn != 1.0/6 || st.ReorderDepth != 3 || st.OutOfOrder != 1 {
+		t.Fatalf("Expected loss 1/6, depth 3 and 1 out of order, got %v, %d and %d",
+			st.LossIn, st.ReorderDepth, st.OutOfOrder)
+	}
+
+	// Older packets within the window are recognised as duplicates.
+	p.stats.received(2, 10)
+	p.stats.received(3, 10)
+	if st = p.Stats(); st.Duplicates != 2 {
+		t.Fatalf("Expected 2 duplicates, got %d", st.Duplicates)
+	}
+
+	// Once the window has moved on, the gap and the reordering are forgotten.
+	for seq := Seq(7); seq < 7+seqWindow; seq++ {
+		p.stats.received(seq, 10)
+	}
+
+	if st = p.Stats(); st.LossIn != 0 || st.ReorderDepth != 0 {
+		t.Fatalf("Expected no loss and no reordering, got %v and %d", st.LossIn, st.ReorderDepth)
+	}
+}
+
+func TestStatsReplay(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	server, r := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, nil)
+	defer server.Close()
+
+	from, err := n.Listen("10.0.0.2:7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer from.Close()
+
+	// Nobody answers the pings of the server.
+	go func() {
+		b := make([]uint8, PacketSize)
+		for {
+			if _, _, err := from.ReadFrom(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	packet := func(seq int) []uint8 {
+		return sealed(0, 2, 0, uint8(seq>>8), uint8(seq), MsgData, 'x')
+	}
+
+	for seq := 0; seq < 300; seq++ {
+		from.WriteTo(packet(seq), server.Addr)
+	}
+	n.Flush()
+
+	if got := len(r.take(MsgData)); got != 300 {
+		t.Fatalf("Expected 300 messages, got %d", got)
+	}
+
+	// Packet 0 is long out of the window. It is dropped all the same, and so
+	// is one in the window.
+	from.WriteTo(packet(0), server.Addr)
+	from.WriteTo(packet(0), server.Addr)
+	from.WriteTo(packet(299), server.Addr)
+	n.Flush()
+
+	if got := len(r.take(MsgData)); got != 0 {
+		t.Fatalf("Expected the replayed packets to be dropped, got %d messages", got)
+	}
+
+	p := server.Clients()[0]
+	if st := p.Stats(); st.Duplicates != 3 {
+		t.Fatalf("Expected 3 duplicates, got %d", st.Duplicates)
+	}
+
+	// Dropped packets do not keep the peer alive. Once it has timed out, it
+	// may start over.
+	for i := 0; i < 6; i++ {
+		from.WriteTo(packet(0), server.Addr)
+		n.Flush()
+		clock.Advance(time.Second)
+	}
+
+	if server.HasClient(p.Id) {
+		t.Fatalf("Expected the peer to time out")
+	}
+
+	from.WriteTo(packet(0), server.Addr)
+	n.Flush()
+
+	if got := len(r.take(MsgData)); got != 1 {
+		t.Fatalf("Expected the restarted peer to get through, got %d messages", got)
+	}
+}
+
+func TestStatsLossReport(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	server, _ := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, nil, nil)
+	acfg, asim := simulated(clock)
+	a, _ := newMemoryPeer(t, n, clock, "10.0.0.2:7000", 2, nil, acfg)
+	defer server.Close()
+	defer a.Close()
+
+	// 3 out of 8 packets from a get lost.
+	for i := 0; i < 8; i++ {
+		if i >= 1 && i <= 3 {
+			asim.SetOutbound(Conditions{Loss: 1})
+		} else {
+			asim.SetOutbound(Conditions{})
+		}
+		a.SendTo(server.Addr, []byte("hello"))
+	}
+	n.Flush()
+
+	client := server.GetClient(a.Id)
+	if st := client.Stats(); st.LossIn != 3.0/8 {
+		t.Fatalf("Expected inbound loss of 3/8 at the server, got %v", st.LossIn)
+	}
+
+	// The server's ping tells a about it, and a's pong reports no loss the
+	// other way.
+	clock.Advance(time.Second)
+	n.Flush()
+
+	if st := a.GetClient(server.Id).Stats(); st.LossOut < 0.374 || st.LossOut > 0.376 {
+		t.Fatalf("Expected outbound loss of 3/8 at a, got %v", st.LossOut)
+	}
+
+	if st := client.Stats(); st.LossOut != 0 {
+		t.Fatalf("Expected no outbound loss at the server, got %v", st.LossOut)
+	}
+}
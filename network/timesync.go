@@ -0,0 +1,102 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// Number of clock samples we keep per peer. The one with the lowest round trip
+// time is used, because it suffered the least from queueing delays.
+const clockSamples = 8
+
+// Estimates the offset between our clock and the clock of a peer, from the
+// four timestamps of a ping/pong exchange (see RFC 5905, section 8):
+//
+//	t1: we send a ping       (our clock)
+//	t2: the peer receives it (peer's clock)
+//	t3: the peer sends pong  (peer's clock)
+//	t4: we receive the pong  (our clock)
+//
+// The round trip time is (t4 - t1) - (t3 - t2) and the offset of the peer's
+// clock is ((t2 - t1) + (t3 - t4)) / 2. The estimate assumes the paths in both
+// directions take equally long.
+type clockSync struct {
+	lock    sync.Mutex
+	samples [clockSamples]clockSample
+	count   int           // Number of samples taken so far.
+	offset  time.Duration // Offset of the best sample.
+}
+
+type clockSample struct {
+	rtt    time.Duration
+	offset time.Duration
+}
+
+// Records a clock sample. Timestamps are in microseconds. Returns the round
+// trip time, without the time the peer took to answer.
+func (this *clockSync) sample(t1, t2, t3, t4 int64) time.Duration {
+	s := clockSample{
+		rtt:    time.Duration((t4-t1)-(t3-t2)) * time.Microsecond,
+		offset: time.Duration(((t2-t1)+(t3-t4))/2) * time.Microsecond,
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.samples[this.count%clockSamples] = s
+	this.count++
+
+	n := this.count
+	if n > clockSamples {
+		n = clockSamples
+	}
+
+	best := this.samples[0]
+	for _, s := range this.samples[1:n] {
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+
+	this.offset = best.offset
+	return s.rtt
+}
+
+// Returns the estimated offset of this peer's clock, relative to the clock of
+// the listener which knows it: positive if the peer's clock is ahead of ours.
+// It is 0 until the first pong with timestamps arrives.
+func (this *Peer) ClockOffset() time.Duration {
+	this.clocksync.lock.Lock()
+	defer this.clocksync.lock.Unlock()
+	return this.clocksync.offset
+}
+
+// Returns the current time on this peer's clock, as estimated from ours. On a
+// client, call this on the server peer (see Conn.ServerTime) to schedule input
+// and interpolation on server ticks.
+func (this *Peer) ServerTime() time.Time {
+	c := this.clock
+	if this.host != nil {
+		c = this.host.clock
+	}
+	return c.Now().Add(this.ClockOffset())
+}
+
+// Reads a 64 bit timestamp in microseconds.
+func getTimestamp(b []uint8) int64 {
+	return int64(b[0])<<56 | int64(b[1])<<48 | int64(b[2])<<40 |
+		int64(b[3])<<32 | int64(b[4])<<24 | int64(b[5])<<16 |
+		int64(b[6])<<8 | int64(b[7])
+}
+
+// Writes a 64 bit timestamp in microseconds.
+func putTimestamp(b []uint8, ms int64) {
+	b[0] = uint8(ms >> 56)
+	b[1] = uint8(ms >> 48)
+	b[2] = uint8(ms >> 40)
+	b[3] = uint8(ms >> 32)
+	b[4] = uint8(ms >> 24)
+	b[5] = uint8(ms >> 16)
+	b[6] = uint8(ms >> 8)
+	b[7] = uint8(ms)
+}
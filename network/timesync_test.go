@@ -0,0 +1,79 @@
+package network
+
+import "testing"
+import "time"
+
+// A clock which runs ahead of another one.
+type offsetClock struct {
+	*ManualClock
+	offset time.Duration
+}
+
+func (this offsetClock) Now() time.Time { return this.ManualClock.Now().Add(this.offset) }
+
+func TestClockSync(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	sclock := offsetClock{clock, 5 * time.Second}
+	scfg, ssim := simulated(sclock)
+	server, _ := newMemoryPeer(t, n, sclock, "10.0.0.1:7000", 1, nil, scfg)
+	acfg, asim := simulated(clock)
+	a, _ := newMemoryPeer(t, n, clock, "10.0.0.2:7000", 2, nil, acfg)
+	defer server.Close()
+	defer a.Close()
+
+	ssim.SetOutbound(Conditions{Delay: 50 * time.Millisecond})
+	asim.SetOutbound(Conditions{Delay: 50 * time.Millisecond})
+
+	a.SendTo(server.Addr, []byte("hello"))
+
+	// The server pings a at 1s, which pings the server back at 2s.
+	for i := 0; i < 42; i++ {
+		clock.Advance(50 * time.Millisecond)
+		n.Flush()
+	}
+
+	s := a.GetClient(server.Id)
+	if s == nil {
+		t.Fatalf("a does not know the server")
+	}
+
+	if off := s.ClockOffset(); off != 5*time.Second {
+		t.Fatalf("Expected the server to be 5s ahead, got %v", off)
+	}
+
+	if now := s.ServerTime(); !now.Equal(clock.Now().Add(5 * time.Second)) {
+		t.Fatalf("Expected server time %v, got %v", clock.Now().Add(5*time.Second), now)
+	}
+
+	if off := server.GetClient(a.Id).ClockOffset(); off != -5*time.Second {
+		t.Fatalf("Expected a to be 5s behind, got %v", off)
+	}
+
+	if rtt := s.Stats().RTT; rtt != 100*time.Millisecond {
+		t.Fatalf("Expected RTT 100ms, got %v", rtt)
+	}
+}
+
+func TestClockFilter(t *testing.T) {
+	var c clockSync
+
+	// The sample with the lowest round trip time wins, even if later
+	// samples suffered from queueing in one direction.
+	c.sample(0, 1050, 1050, 100)   // rtt 100, offset 1000
+	c.sample(200, 1400, 1400, 400) // rtt 200, offset 1100
+	c.sample(500, 1550, 1550, 600) // rtt 100, offset 1000
+
+	if c.offset != time.Millisecond {
+		t.Fatalf("Expected offset 1ms, got %v", c.offset)
+	}
+
+	for i := int64(0); i < clockSamples; i++ {
+		c.sample(i*1000, i*1000+2100, i*1000+2100, i*1000+200) // rtt 200, offset 2000
+	}
+
+	if c.offset != 2*time.Millisecond {
+		t.Fatalf("Expected old samples to expire, got %v", c.offset)
+	}
+}
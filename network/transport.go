@@ -0,0 +1,74 @@
+package network
+
+import (
+	"net"
+)
+
+// This interface represents the datagram socket a Peer reads from and writes
+// to. By default, Peer.Listen opens a UDP socket, but any implementation can
+// be handed to Peer.Serve instead: an in-memory transport for tests, a
+// simulated lossy network, a relay, etc. Every net.PacketConn satisfies this
+// interface, so a Unix datagram socket (net.ListenUnixgram) can be used as-is.
+//
+// ReadFrom and WriteTo must be safe for concurrent use. Close must cause any
+// blocked ReadFrom call to return with an error.
+type Transport interface {
+	ReadFrom(b []byte) (n int, addr net.Addr, err error)
+	WriteTo(b []byte, addr net.Addr) (n int, err error)
+	Close() error
+	LocalAddr() net.Addr
+}
+
+// A single datagram, as read or written by a BatchTransport.
+type Datagram struct {
+	Buffer []byte   // Datagram content. On read, the buffer to read into.
+	N      int      // On read, the number of bytes read into Buffer.
+	Addr   net.Addr // Source address on read, destination address on write.
+}
+
+// A Transport which can move several datagrams per call. On Linux, the UDP
+// sockets opened by this package implement this with the recvmmsg and
+// sendmmsg system calls. See Config.BatchSize.
+type BatchTransport interface {
+	Transport
+
+	// Blocks until at least one datagram is available and reads as many as
+	// are ready, up to len(msgs). Returns the number of datagrams read.
+	ReadBatch(msgs []Datagram) (int, error)
+
+	// Writes the datagrams. Returns the number of datagrams written.
+	WriteBatch(msgs []Datagram) (int, error)
+}
+
+// Returns the 16 byte address we use to identify the sender of a packet. For
+// IP based addresses this is the IPv6 form of the IP. Other address types (eg:
+// unix sockets) have no IP, so we use an Md5 hash of the address string. It
+// has the right size and is just as unique.
+func addrIP(addr net.Addr) []byte {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.To16()
+	case *net.IPAddr:
+		return a.IP.To16()
+	}
+	return md5hash([]byte(addr.Network() + ":" + addr.String()))
+}
+
+// Writes addrIP(addr) into the first 16 bytes of dst. Unlike addrIP, this
+// does not allocate for the addresses returned by a UDP socket.
+func putAddrIP(dst []byte, addr net.Addr) {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		switch len(a.IP) {
+		case net.IPv4len:
+			copy(dst, v4InV6Prefix)
+			copy(dst[12:16], a.IP)
+			return
+		case net.IPv6len:
+			copy(dst, a.IP)
+			return
+		}
+	}
+	copy(dst, addrIP(addr))
+}
+
+var v4InV6Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
@@ -0,0 +1,25 @@
+//go:build ignore
+
+// Writes gnarly.lua. Run through go generate.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/snuk182/gnarly/network/wireshark"
+)
+
+func main() {
+	var buf bytes.Buffer
+	if err := wireshark.Generate(&buf); err != nil {
+		fmt.Fprintf(os.Stderr, "[e] %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := os.WriteFile("gnarly.lua", buf.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "[e] %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,139 @@
+-- Wireshark dissector for the gnarly wire format.
+--
+-- Generated by network/wireshark from the protocol definition in
+-- network/protocol.go. Do not edit. Run go generate in network/wireshark.
+--
+-- Gnarly has no well known port. Set it in the protocol preferences (or with
+-- -o gnarly.port:<port>), or pick the protocol through Decode As.
+
+local gnarly = Proto("gnarly", "Gnarly")
+
+local header_size = 5
+local fragment_header_size = 7
+local trailer_size = 5
+local protocol_version = 1
+local flag_fragmented = 0x04
+local flag_reject = 0x08
+local flag_transformed = 0x03 -- Compressed or encrypted.
+
+local message_types = {
+	[0] = "MsgData",
+	[1] = "MsgPing",
+	[2] = "MsgPong",
+	[3] = "MsgPeerConnected",
+	[4] = "MsgPeerDisconnected",
+	[5] = "MsgLatency",
+	[6] = "MsgConnect",
+	[7] = "MsgAccept",
+	[8] = "MsgProbe",
+	[9] = "MsgProbeAck",
+}
+
+local f = gnarly.fields
+f.clientid = ProtoField.uint16("gnarly.clientid", "Client ID", base.HEX)
+f.flags = ProtoField.uint8("gnarly.flags", "Flags", base.HEX)
+f.seq = ProtoField.uint16("gnarly.seq", "Sequence", base.DEC)
+f.frag_index = ProtoField.uint8("gnarly.frag_index", "Fragment index", base.DEC)
+f.frag_count = ProtoField.uint8("gnarly.frag_count", "Fragment count", base.DEC)
+f.version = ProtoField.uint8("gnarly.version", "Protocol version", base.DEC)
+f.checksum = ProtoField.uint32("gnarly.checksum", "Checksum", base.HEX)
+f.flags_compressed = ProtoField.bool("gnarly.flags.compressed", "Compressed", 8, nil, 0x01)
+f.flags_encrypted = ProtoField.bool("gnarly.flags.encrypted", "Encrypted", 8, nil, 0x02)
+f.flags_fragmented = ProtoField.bool("gnarly.flags.fragmented", "Fragmented", 8, nil, 0x04)
+f.flags_reject = ProtoField.bool("gnarly.flags.reject", "Rejected", 8, nil, 0x08)
+f.msgtype = ProtoField.uint8("gnarly.msgtype", "Message type", base.DEC, message_types)
+f.data = ProtoField.bytes("gnarly.data", "Data")
+
+gnarly.prefs.port = Pref.uint("UDP port", 0, "UDP port of the gnarly traffic. 0 leaves it to Decode As.")
+gnarly.prefs.plain = Pref.bool("Plain payloads", true,
+	"Decode the message type of compressed or encrypted packets. This is right for the " ..
+	"default compression and encryption, which leave the data as it is.")
+
+function gnarly.dissector(tvb, pinfo, tree)
+	-- The trailer follows the message. Its checksum is not verified here.
+	local length = tvb:len() - trailer_size
+	if length < header_size then
+		return 0
+	end
+
+	local flags = tvb(2, 1):uint()
+	local size = header_size
+	if bit.band(flags, flag_fragmented) ~= 0 then
+		if length < fragment_header_size then
+			return 0
+		end
+		size = fragment_header_size
+	end
+
+	pinfo.cols.protocol = "GNARLY"
+	local t = tree:add(gnarly, tvb())
+	local version = tvb(length + 0, 1):uint()
+	t:add(f.version, tvb(length + 0, 1))
+	t:add(f.checksum, tvb(length + 1, 4))
+
+	-- The header of another version may not be ours.
+	if version ~= protocol_version then
+		pinfo.cols.info = "Protocol version " .. version
+		return tvb:len()
+	end
+
+	t:add(f.clientid, tvb(0, 2))
+
+	local flagtree = t:add(f.flags, tvb(2, 1))
+	flagtree:add(f.flags_compressed, tvb(2, 1))
+	flagtree:add(f.flags_encrypted, tvb(2, 1))
+	flagtree:add(f.flags_fragmented, tvb(2, 1))
+	flagtree:add(f.flags_reject, tvb(2, 1))
+
+	t:add(f.seq, tvb(3, 2))
+
+	local info = "Seq=" .. tvb(3, 2):uint()
+	local index = 0
+
+	if bit.band(flags, flag_reject) ~= 0 then
+		pinfo.cols.info = "Reject " .. info
+		return tvb:len()
+	end
+
+	if bit.band(flags, flag_fragmented) ~= 0 then
+		t:add(f.frag_index, tvb(5, 1))
+		t:add(f.frag_count, tvb(6, 1))
+
+		index = tvb(5, 1):uint()
+		info = info .. " Fragment=" .. (index + 1) .. "/" .. tvb(6, 1):uint()
+	end
+
+	-- The message type is the first byte of the message, so only the first
+	-- fragment carries it. Compression and encryption may hide it.
+	local readable = bit.band(flags, flag_transformed) == 0 or gnarly.prefs.plain
+
+	if length > size and index == 0 and readable then
+		local msgtype = tvb(size, 1):uint()
+		t:add(f.msgtype, tvb(size, 1))
+		info = (message_types[msgtype] or ("Type " .. msgtype)) .. " " .. info
+
+		if length > size + 1 then
+			t:add(f.data, tvb(size + 1, length - size - 1))
+		end
+	elseif length > size then
+		t:add(f.data, tvb(size, length - size))
+	end
+
+	pinfo.cols.info = info
+	return tvb:len()
+end
+
+local udp_port = DissectorTable.get("udp.port")
+udp_port:add_for_decode_as(gnarly)
+
+local registered = 0
+function gnarly.prefs_changed()
+	if registered ~= 0 then
+		udp_port:remove(registered, gnarly)
+	end
+
+	registered = gnarly.prefs.port
+	if registered ~= 0 then
+		udp_port:add(registered, gnarly)
+	end
+end
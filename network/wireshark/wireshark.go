@@ -0,0 +1,206 @@
+// Package wireshark generates a Wireshark dissector for the gnarly wire
+// format, written in Lua. It is generated from the protocol definition in the
+// network package (see network.HeaderFields and network.TrailerFields), so it
+// follows any change to the wire format. The generated dissector is shipped as gnarly.lua in this directory.
+// Run go generate after changing the definition.
+//
+// To use it, copy gnarly.lua to the Wireshark plugin directory (see Help >
+// About Wireshark > Folders), or load it on the command line:
+//
+//	wireshark -X lua_script:gnarly.lua -o gnarly.port:7000 capture.pcapng
+//
+// See network.PcapWriter for capturing the traffic of a Peer.
+package wireshark
+
+//go:generate go run gen.go
+
+import (
+	"fmt"
+	"io"
+	"text/template"
+
+	"github.com/snuk182/gnarly/network"
+)
+
+// Writes the Lua source of the dissector to w.
+func Generate(w io.Writer) error {
+	return dissector.Execute(w, map[string]interface{}{
+		"Fields":             network.HeaderFields,
+		"Trailer":            network.TrailerFields,
+		"Flags":              network.PacketFlags,
+		"Types":              network.MessageTypes,
+		"HeaderSize":         network.HeaderSize,
+		"FragmentHeaderSize": network.FragmentHeaderSize,
+		"TrailerSize":        network.TrailerSize,
+		"Version":            network.ProtocolVersion,
+		"Reject":             network.PFReject,
+		"Fragmented":         network.PFFragmented,
+		"Transformed":        network.PFCompressed | network.PFEncrypted,
+		"FlagField":          field(network.HeaderFields, "flags"),
+		"SeqField":           field(network.HeaderFields, "seq"),
+		"IndexField":         field(network.HeaderFields, "frag_index"),
+		"CountField":         field(network.HeaderFields, "frag_count"),
+		"VersionField":       field(network.TrailerFields, "version"),
+	})
+}
+
+// Returns the field with the given name.
+func field(fields []network.HeaderField, name string) network.HeaderField {
+	for _, f := range fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	panic("wireshark: no field " + name)
+}
+
+var funcs = template.FuncMap{
+	// The ProtoField constructor for a field of the given size.
+	"protofield": func(size int) string {
+		return fmt.Sprintf("ProtoField.uint%d", size*8)
+	},
+
+	"base": func(hex bool) string {
+		if hex {
+			return "base.HEX"
+		}
+		return "base.DEC"
+	},
+
+	"hex": func(v uint8) string {
+		return fmt.Sprintf("0x%02x", v)
+	},
+}
+
+var dissector = template.Must(template.New("gnarly.lua").Funcs(funcs).Parse(`-- Wireshark dissector for the gnarly wire format.
+--
+-- Generated by network/wireshark from the protocol definition in
+-- network/protocol.go. Do not edit. Run go generate in network/wireshark.
+--
+-- Gnarly has no well known port. Set it in the protocol preferences (or with
+-- -o gnarly.port:<port>), or pick the protocol through Decode As.
+
+local gnarly = Proto("gnarly", "Gnarly")
+
+local header_size = {{.HeaderSize}}
+local fragment_header_size = {{.FragmentHeaderSize}}
+local trailer_size = {{.TrailerSize}}
+local protocol_version = {{.Version}}
+local flag_fragmented = {{hex .Fragmented}}
+local flag_reject = {{hex .Reject}}
+local flag_transformed = {{hex .Transformed}} -- Compressed or encrypted.
+
+local message_types = {
+{{- range .Types}}
+	[{{.Value}}] = "{{.Name}}",
+{{- end}}
+}
+
+local f = gnarly.fields
+{{- range .Fields}}
+f.{{.Name}} = {{protofield .Size}}("gnarly.{{.Name}}", "{{.Title}}", {{base .Hex}})
+{{- end}}
+{{- range .Trailer}}
+f.{{.Name}} = {{protofield .Size}}("gnarly.{{.Name}}", "{{.Title}}", {{base .Hex}})
+{{- end}}
+{{- range .Flags}}
+f.flags_{{.Name}} = ProtoField.bool("gnarly.flags.{{.Name}}", "{{.Title}}", 8, nil, {{hex .Value}})
+{{- end}}
+f.msgtype = ProtoField.uint8("gnarly.msgtype", "Message type", base.DEC, message_types)
+f.data = ProtoField.bytes("gnarly.data", "Data")
+
+gnarly.prefs.port = Pref.uint("UDP port", 0, "UDP port of the gnarly traffic. 0 leaves it to Decode As.")
+gnarly.prefs.plain = Pref.bool("Plain payloads", true,
+	"Decode the message type of compressed or encrypted packets. This is right for the " ..
+	"default compression and encryption, which leave the data as it is.")
+
+function gnarly.dissector(tvb, pinfo, tree)
+	-- The trailer follows the message. Its checksum is not verified here.
+	local length = tvb:len() - trailer_size
+	if length < header_size then
+		return 0
+	end
+
+	local flags = tvb({{.FlagField.Offset}}, {{.FlagField.Size}}):uint()
+	local size = header_size
+	if bit.band(flags, flag_fragmented) ~= 0 then
+		if length < fragment_header_size then
+			return 0
+		end
+		size = fragment_header_size
+	end
+
+	pinfo.cols.protocol = "GNARLY"
+	local t = tree:add(gnarly, tvb())
+	local version = tvb(length + {{.VersionField.Offset}}, {{.VersionField.Size}}):uint()
+{{- range .Trailer}}
+	t:add(f.{{.Name}}, tvb(length + {{.Offset}}, {{.Size}}))
+{{- end}}
+
+	-- The header of another version may not be ours.
+	if version ~= protocol_version then
+		pinfo.cols.info = "Protocol version " .. version
+		return tvb:len()
+	end
+{{range .Fields}}{{if not .Flag}}
+	{{- if eq .Name "flags"}}
+	local flagtree = t:add(f.flags, tvb({{.Offset}}, {{.Size}}))
+	{{- range $.Flags}}
+	flagtree:add(f.flags_{{.Name}}, tvb({{$.FlagField.Offset}}, {{$.FlagField.Size}}))
+	{{- end}}
+	{{- else}}
+	t:add(f.{{.Name}}, tvb({{.Offset}}, {{.Size}}))
+	{{- end}}
+{{end}}{{end}}
+	local info = "Seq=" .. tvb({{.SeqField.Offset}}, {{.SeqField.Size}}):uint()
+	local index = 0
+
+	if bit.band(flags, flag_reject) ~= 0 then
+		pinfo.cols.info = "Reject " .. info
+		return tvb:len()
+	end
+
+	if bit.band(flags, flag_fragmented) ~= 0 then
+{{- range .Fields}}{{if .Flag}}
+		t:add(f.{{.Name}}, tvb({{.Offset}}, {{.Size}}))
+{{- end}}{{end}}
+
+		index = tvb({{.IndexField.Offset}}, {{.IndexField.Size}}):uint()
+		info = info .. " Fragment=" .. (index + 1) .. "/" .. tvb({{.CountField.Offset}}, {{.CountField.Size}}):uint()
+	end
+
+	-- The message type is the first byte of the message, so only the first
+	-- fragment carries it. Compression and encryption may hide it.
+	local readable = bit.band(flags, flag_transformed) == 0 or gnarly.prefs.plain
+
+	if length > size and index == 0 and readable then
+		local msgtype = tvb(size, 1):uint()
+		t:add(f.msgtype, tvb(size, 1))
+		info = (message_types[msgtype] or ("Type " .. msgtype)) .. " " .. info
+
+		if length > size + 1 then
+			t:add(f.data, tvb(size + 1, length - size - 1))
+		end
+	elseif length > size then
+		t:add(f.data, tvb(size, length - size))
+	end
+
+	pinfo.cols.info = info
+	return tvb:len()
+end
+
+local udp_port = DissectorTable.get("udp.port")
+udp_port:add_for_decode_as(gnarly)
+
+local registered = 0
+function gnarly.prefs_changed()
+	if registered ~= 0 then
+		udp_port:remove(registered, gnarly)
+	end
+
+	registered = gnarly.prefs.port
+	if registered ~= 0 then
+		udp_port:add(registered, gnarly)
+	end
+end
+`))
@@ -0,0 +1,236 @@
+package wireshark
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snuk182/gnarly/network"
+)
+
+var update = flag.Bool("update", false, "Rewrite gnarly.lua and the golden packets.")
+
+func TestGenerate(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Generate(&buf); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	if *update {
+		os.WriteFile("gnarly.lua", buf.Bytes(), 0644)
+	}
+
+	if lua, err := os.ReadFile("gnarly.lua"); err != nil || !bytes.Equal(lua, buf.Bytes()) {
+		t.Fatalf("gnarly.lua is out of date. Run go generate.")
+	}
+}
+
+// Checks the offsets and sizes in the generated dissector against the field
+// definitions of the network package. This only reads the Lua source; whether
+// Wireshark decodes the packets that way is up to TestGolden, which needs
+// tshark.
+func TestFieldLayout(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Generate(&buf); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	lua := buf.String()
+
+	types := map[int]string{1: "uint8", 2: "uint16", 4: "uint32"}
+	check := func(f network.HeaderField, at string) {
+		display := "base.DEC"
+		if f.Hex {
+			display = "base.HEX"
+		}
+
+		decl := fmt.Sprintf("f.%s = ProtoField.%s(\"gnarly.%s\", %q, %s)", f.Name, types[f.Size], f.Name, f.Title, display)
+		if !strings.Contains(lua, decl) {
+			t.Errorf("Expected the dissector to declare %s", decl)
+		}
+
+		add := fmt.Sprintf("t:add(f.%s, tvb(%s, %d))", f.Name, at, f.Size)
+		if !strings.Contains(lua, add) {
+			t.Errorf("Expected the dissector to show %s", add)
+		}
+	}
+
+	var header, fragment int
+	for _, f := range network.HeaderFields {
+		check(f, fmt.Sprint(f.Offset))
+
+		fragment = max(fragment, f.Offset+f.Size)
+		if f.Flag == 0 {
+			header = max(header, f.Offset+f.Size)
+		}
+	}
+
+	for _, f := range network.TrailerFields {
+		check(f, fmt.Sprintf("length + %d", f.Offset))
+	}
+
+	for _, size := range []string{
+		fmt.Sprintf("local header_size = %d\n", header),
+		fmt.Sprintf("local fragment_header_size = %d\n", fragment),
+		fmt.Sprintf("local trailer_size = %d\n", network.TrailerSize),
+	} {
+		if !strings.Contains(lua, size) {
+			t.Errorf("Expected the dissector to define %s", strings.TrimSpace(size))
+		}
+	}
+}
+
+// Captures a session between a server on port 7000 and a client, with data,
+// fragments, pings and pongs. Everything runs on a manual clock, so the
+// capture is the same every time.
+func session(t *testing.T) []uint8 {
+	clock := network.NewManualClock(time.Unix(1e9, 0))
+	n := network.NewMemoryNetwork()
+
+	var buf bytes.Buffer
+	pw, _ := network.NewPcapWriter(&buf)
+
+	eh := func(error) bool { return false }
+	mh := func(*network.Peer, uint8, interface{}) {}
+
+	var peers []*network.Peer
+	for i, addr := range []string{"10.0.0.1:7000", "10.0.0.2:5000"} {
+		tr, err := n.Listen(addr)
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+
+		p, _ := network.NewPeer(tr.LocalAddr(), []uint8{0, uint8(i + 1)})
+		cfg := &network.Config{Transport: tr, Clock: clock, PingInterval: time.Second}
+		if i == 0 {
+			cfg.Capture = pw
+		}
+
+		if err = p.ListenConfig(cfg, mh, eh); err != nil {
+			t.Fatalf("ListenConfig: %v", err)
+		}
+		defer p.Close()
+		peers = append(peers, p)
+	}
+
+	peers[1].SendTo(peers[0].Addr, []uint8("hello"))
+	peers[1].SendTo(peers[0].Addr, bytes.Repeat([]uint8{'x'}, 2*network.PacketSize))
+	peers[0].SendTo(peers[1].Addr, []uint8("welcome"))
+	n.Flush()
+
+	clock.Advance(time.Second)
+	n.Flush()
+	return buf.Bytes()
+}
+
+// Decodes the packets of a capture in the Go code, into the fields the
+// dissector should show: the header fields, the trailer fields, then the
+// message type.
+func decode(t *testing.T, pcap []uint8) string {
+	var out strings.Builder
+	r := network.NewPcapReader(bytes.NewReader(pcap))
+
+	for {
+		c, err := r.ReadCapture()
+		if err != nil {
+			break
+		}
+
+		size := len(c.Data) - network.TrailerSize
+		packet := make(network.Packet, 16+size)
+		copy(packet[16:], c.Data)
+
+		var values []string
+		for _, f := range network.HeaderFields {
+			if f.Flag != 0 && packet.Flags()&f.Flag == 0 {
+				values = append(values, "")
+				continue
+			}
+			values = append(values, value(f, c.Data))
+		}
+
+		for _, f := range network.TrailerFields {
+			values = append(values, value(f, c.Data[size:]))
+		}
+
+		// Only the first fragment starts with the message type.
+		msgtype := ""
+		if s1, _ := packet.SubSequence(); s1 == 0 {
+			msgtype = fmt.Sprint(packet.Data()[0])
+		}
+
+		fmt.Fprintln(&out, strings.Join(append(values, msgtype), ","))
+	}
+	return out.String()
+}
+
+// Formats a field of b the way tshark does.
+func value(f network.HeaderField, b []uint8) string {
+	var v uint64
+	for _, x := range b[f.Offset : f.Offset+f.Size] {
+		v = v<<8 | uint64(x)
+	}
+
+	if f.Hex {
+		return fmt.Sprintf("0x%0*x", 2*f.Size, v)
+	}
+	return fmt.Sprint(v)
+}
+
+func TestGolden(t *testing.T) {
+	pcap := session(t)
+
+	if *update {
+		os.MkdirAll("testdata", 0755)
+		os.WriteFile("testdata/golden.pcapng", pcap, 0644)
+		os.WriteFile("testdata/golden.txt", []uint8(decode(t, pcap)), 0644)
+	}
+
+	golden, err := os.ReadFile("testdata/golden.pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A change here means the wire format changed. Check that the dissector
+	// still decodes the packets, then run the tests with -update.
+	if !bytes.Equal(golden, pcap) {
+		t.Fatalf("The Go code no longer encodes the golden packets")
+	}
+
+	want, err := os.ReadFile("testdata/golden.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := decode(t, golden); got != string(want) {
+		t.Fatalf("The golden packets decode as:\n%s\nwant:\n%s", got, want)
+	}
+
+	tshark, err := exec.LookPath("tshark")
+	if err != nil {
+		t.Skip("tshark not found; the dissector itself is not tested")
+	}
+
+	args := []string{"-X", "lua_script:gnarly.lua", "-o", "gnarly.port:7000",
+		"-r", "testdata/golden.pcapng", "-T", "fields", "-E", "separator=,"}
+	for _, f := range network.HeaderFields {
+		args = append(args, "-e", "gnarly."+f.Name)
+	}
+	for _, f := range network.TrailerFields {
+		args = append(args, "-e", "gnarly."+f.Name)
+	}
+	args = append(args, "-e", "gnarly.msgtype")
+
+	out, err := exec.Command(tshark, args...).Output()
+	if err != nil {
+		t.Fatalf("tshark: %v", err)
+	}
+
+	if string(out) != string(want) {
+		t.Fatalf("The dissector decodes the golden packets as:\n%s\nwant:\n%s", out, want)
+	}
+}
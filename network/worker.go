@@ -0,0 +1,67 @@
+package network
+
+import "net"
+
+// A packet handed from the polling loop to a worker.
+type job struct {
+	addr   net.Addr
+	packet *buffer // Pooled copy of the packet. Released once it has been processed.
+	stamp  int64
+}
+
+// Number of packets which can be queued for a single worker, before the
+// polling loop has to wait for it.
+const workerQueueSize = 256
+
+// Starts n packet processing workers. With n <= 1, no workers are started and
+// packets are processed on the polling goroutine. Called with this.lock held.
+func (this *Peer) startWorkers(n int) {
+	this.workers = nil
+	if n <= 1 {
+		return
+	}
+
+	this.workers = make([]chan job, n)
+	for i := range this.workers {
+		this.workers[i] = make(chan job, workerQueueSize)
+		this.working.Add(1)
+		this.running++
+		go this.work(this.workers[i])
+	}
+}
+
+// Processes queued packets until the queue is closed.
+func (this *Peer) work(queue chan job) {
+	defer this.working.Done()
+	defer this.leave()
+
+	for j := range queue {
+		this.process(j.addr, Packet(j.packet.b), j.stamp)
+		j.packet.release()
+	}
+}
+
+// Hands a packet to the worker responsible for its sender. The sender is
+// identified by the same bytes used for Packet.Owner: the 16 byte address and
+// the 2 byte client id. We hash them with FNV-1a. The packet lives in the poll
+// buffer, so it is copied.
+func (this *Peer) dispatch(addr net.Addr, packet Packet, stamp int64) {
+	h := uint32(2166136261)
+	for _, b := range packet[0:18] {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+
+	buf := getBuffer(len(packet))
+	copy(buf.b, packet)
+
+	this.workers[h%uint32(len(this.workers))] <- job{addr, buf, stamp}
+}
+
+// Tells the workers to exit once they have processed their queues. The
+// polling goroutine waits for them through this.working.
+func (this *Peer) stopWorkers() {
+	for _, queue := range this.workers {
+		close(queue)
+	}
+}
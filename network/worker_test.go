@@ -0,0 +1,69 @@
+package network
+
+import (
+	"encoding/binary"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestWorkerOrder(t *testing.T) {
+	clock := NewManualClock(time.Unix(1e9, 0))
+	n := NewMemoryNetwork()
+
+	// The handler yields before recording, so messages handed to different
+	// workers would get the chance to overtake each other.
+	r := new(recorder)
+	mh := func(p *Peer, msgtype uint8, data interface{}) {
+		runtime.Gosched()
+		r.handle(p, msgtype, data)
+	}
+
+	cfg := &peerConfig{Config: Config{Workers: 4, PingInterval: time.Minute, Timeout: time.Hour}}
+	server, _ := newMemoryPeer(t, n, clock, "10.0.0.1:7000", 1, mh, cfg)
+	defer server.Close()
+
+	var peers []*Peer
+	for i, addr := range []string{"10.0.0.2:7000", "10.0.0.3:7000", "10.0.0.4:7000", "10.0.0.5:7000", "10.0.0.6:7000"} {
+		p, _ := newMemoryPeer(t, n, clock, addr, uint8(i+2), nil, nil)
+		defer p.Close()
+		peers = append(peers, p)
+	}
+
+	// Interleave the peers, each sending its messages numbered in order.
+	const count = 500
+	data := make([]uint8, 2)
+	for i := 0; i < count; i++ {
+		binary.BigEndian.PutUint16(data, uint16(i))
+		for _, p := range peers {
+			if err := p.SendTo(server.Addr, data); err != nil {
+				t.Fatalf("SendTo: %v", err)
+			}
+		}
+		if i%50 == 0 {
+			n.Flush()
+		}
+	}
+	n.Flush()
+
+	// Step does not wait for the workers.
+	var got []message
+	deadline := time.Now().Add(10 * time.Second)
+	for len(got) < count*len(peers) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		got = append(got, r.take(MsgData)...)
+	}
+
+	if len(got) != count*len(peers) {
+		t.Fatalf("Expected %d messages, got %d", count*len(peers), len(got))
+	}
+
+	next := make(map[string]int)
+	for _, m := range got {
+		i := int(binary.BigEndian.Uint16(m.data.([]uint8)))
+		if i != next[m.peer] {
+			t.Fatalf("Expected message %d from %q, got %d", next[m.peer], m.peer, i)
+		}
+		next[m.peer]++
+	}
+}